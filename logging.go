@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+)
+
+// logLevelEnv sets the minimum level logged by the Tomon client: debug, info, warn, error or off.
+// Message payloads are only logged at debug. Defaults to error.
+const logLevelEnv = "TOMON_LOG_LEVEL"
+
+// logFormatEnv selects the log format: text (default) or json.
+const logFormatEnv = "TOMON_LOG_FORMAT"
+
+// logger is shared by the Tomon client and the account.
+var logger = loggerFromEnv()
+
+func loggerFromEnv() tomon.Logger {
+	level := tomon.LevelError
+	var levelErr error
+	if s := os.Getenv(logLevelEnv); s != "" {
+		level, levelErr = tomon.ParseLogLevel(s)
+		if levelErr != nil {
+			level = tomon.LevelError
+		}
+	}
+	var r tomon.Logger
+	if strings.EqualFold(os.Getenv(logFormatEnv), "json") {
+		r = tomon.NewJSONLogger(os.Stderr, level)
+	} else {
+		r = tomon.NewTextLogger(os.Stderr, level)
+	}
+	if levelErr != nil {
+		r.Log(tomon.LevelError, "invalid "+logLevelEnv+", falling back to error", "err", levelErr)
+	}
+	return r
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
@@ -18,8 +21,40 @@ import (
 var event *ubot.AccountEventEmitter
 var bot *tomon.Bot
 
+// requestTimeout bounds every UBot call that queries Tomon, sendTimeout bounds a whole outgoing message including uploads.
+const requestTimeout = 30 * time.Second
+const sendTimeout = 5 * time.Minute
+
+// maxUploadSizeEnv limits the bytes of files sent in one message, e.g. TOMON_MAX_UPLOAD_SIZE=104857600.
+const maxUploadSizeEnv = "TOMON_MAX_UPLOAD_SIZE"
+
+// catchUpMessagesEnv enables forwarding the messages missed while disconnected, up to this many per channel.
+const catchUpMessagesEnv = "TOMON_CATCH_UP_MESSAGES"
+
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), requestTimeout)
+}
+
+func download(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
 func getGroupName(id string) (string, error) {
-	info, err := bot.Channel(id)
+	ctx, cancel := requestContext()
+	defer cancel()
+	info, err := bot.ChannelCtx(ctx, id)
 	if err != nil {
 		return "", err
 	}
@@ -32,11 +67,37 @@ func getUserName(id string) (string, error) {
 	}
 	return info.Name, nil
 }
+
+// replySnippetLength is how many characters of the replied message are quoted in a reply entity.
+const replySnippetLength = 50
+
+// replyEntity refers to the message replied to, e.g. [reply:123,author=456,text=quoted text].
+func replyEntity(reply *tomon.MessageInfo) ubot.MsgEntity {
+	entity := ubot.MsgEntity{
+		Type:      "reply",
+		Args:      []string{reply.ID},
+		NamedArgs: map[string]string{},
+	}
+	if reply.Author != nil {
+		entity.NamedArgs["author"] = reply.Author.ID
+	}
+	if reply.Content != nil && *reply.Content != "" {
+		text := []rune(*reply.Content)
+		if len(text) > replySnippetLength {
+			text = append(text[:replySnippetLength], '…')
+		}
+		entity.NamedArgs["text"] = string(text)
+	}
+	return entity
+}
 func toUBotMessage(msg *tomon.MessageInfo) string {
 	//dbgBytes, _ := json.MarshalIndent(msg, "", "    ")
 	//fmt.Println(string(dbgBytes))
 
 	var builder ubot.MsgBuilder
+	if msg.Reply != nil && msg.Reply.ID != "" {
+		builder.WriteEntity(replyEntity(msg.Reply))
+	}
 	for _, attachment := range msg.Attachments {
 		if attachment.Height|attachment.Width == 0 {
 			builder.WriteEntity(ubot.MsgEntity{
@@ -51,140 +112,401 @@ func toUBotMessage(msg *tomon.MessageInfo) string {
 			})
 		}
 	}
+	for _, stamp := range msg.Stamps {
+		// Stamps are shown as images, the stamp ID allows apps to send the same stamp back.
+		namedArgs := map[string]string{"stamp": stamp.ID}
+		if stamp.Animated {
+			namedArgs["animated"] = "true"
+		}
+		builder.WriteEntity(ubot.MsgEntity{
+			Type:      "image",
+			Args:      []string{stamp.URL},
+			NamedArgs: namedArgs,
+		})
+	}
 	if msg.Content != nil {
-		builder.WriteString(*msg.Content)
+		writeContent(&builder, *msg.Content, msg.Mentions)
 	}
 
 	r := builder.String()
-	for _, at := range msg.Mentions {
-		r = strings.ReplaceAll(r, fmt.Sprintf("<@%s>", at.ID), fmt.Sprintf("[at:%s]", at.ID))
-	}
-
 	//fmt.Println(r)
 	return r
 }
+
+// writeContent writes the content of a message, turning the mentions of users in mentions into at entities.
+// Other entities, e.g. the text quoted by a reply, keep mentions as they are.
+func writeContent(builder *ubot.MsgBuilder, content string, mentions []tomon.UserInfo) {
+	for content != "" {
+		next, length, userID := -1, 0, ""
+		for _, at := range mentions {
+			token := fmt.Sprintf("<@%s>", at.ID)
+			if i := strings.Index(content, token); i >= 0 && (next < 0 || i < next) {
+				next, length, userID = i, len(token), at.ID
+			}
+		}
+		if next < 0 {
+			builder.WriteString(content)
+			return
+		}
+		builder.WriteString(content[:next])
+		builder.WriteEntity(ubot.MsgEntity{Type: "at", Args: []string{userID}})
+		content = content[next+length:]
+	}
+}
+
+// chatSource classifies a Tomon channel for UBot: messages in DM channels are private messages
+// without a source, the sender being the other side of the DM. Group DMs have several other
+// members, so they are groups like guild channels and replies go back to the channel.
+// guildID is the guild the event came from, if known, which saves looking the channel up.
+// Unknown channels are fetched once, private ones are then cached by the bot.
+func chatSource(channelID string, guildID string) (ubot.MsgType, string) {
+	if channelID == "" || channelID == "0" {
+		return ubot.PrivateMsg, ""
+	}
+	if guildID != "" {
+		return ubot.GroupMsg, channelID
+	}
+	channel, ok := bot.CachedChannel(channelID)
+	if !ok {
+		ctx, cancel := requestContext()
+		defer cancel()
+		var err error
+		channel, err = bot.ChannelCtx(ctx, channelID)
+		if err != nil {
+			return ubot.GroupMsg, channelID
+		}
+	}
+	if channel.Type == tomon.ChannelTypeDM {
+		return ubot.PrivateMsg, ""
+	}
+	return ubot.GroupMsg, channelID
+}
+
+// receiveReaction forwards a reaction to UBot as a message from the reacting user made of a single entity,
+// e.g. [reaction:👍,message=123,action=add].
+func receiveReaction(reaction *tomon.MessageReactionInfo, action string) {
+	if reaction.UserID == bot.Self().ID {
+		return
+	}
+	var builder ubot.MsgBuilder
+	builder.WriteEntity(ubot.MsgEntity{
+		Type:      "reaction",
+		Args:      []string{reaction.Emoji.String()},
+		NamedArgs: map[string]string{"message": reaction.MessageID, "action": action},
+	})
+	msgType, source := chatSource(reaction.ChannelID, reaction.GuildID)
+	_ = event.OnReceiveChatMessage(msgType, source, reaction.UserID, builder.String(), ubot.MsgInfo{})
+}
 func login(loginInfo tomon.LoginInfo) error {
 	var err error
-	bot, err = tomon.New(loginInfo)
+	// Keep retrying through Tomon outages instead of giving up the account, but report
+	// a Tomon that cannot be reached at startup rather than waiting for it silently.
+	reconnectPolicy := tomon.DefaultReconnectPolicy()
+	reconnectPolicy.MaxInitialAttempts = reconnectPolicy.MaxAttempts
+	reconnectPolicy.MaxAttempts = 0
+	options := tomon.Options{ReconnectPolicy: &reconnectPolicy, Logger: logger}
+	if s := os.Getenv(maxUploadSizeEnv); s != "" {
+		options.MaxUploadSize, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", maxUploadSizeEnv, err)
+		}
+	}
+	if s := os.Getenv(catchUpMessagesEnv); s != "" {
+		options.CatchUpMessages, err = strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", catchUpMessagesEnv, err)
+		}
+	}
+	bot, err = tomon.NewWithOptions(loginInfo, metricsOptions(options))
 	if err != nil {
 		return err
 	}
+	serveMetrics()
 	bot.Event.OnClose = func(err error) {
 		if err != nil {
-			panic(fmt.Errorf("the connection is closed unexpectedly: %w", err))
+			// Panics in callbacks are recovered by the bot, so exit explicitly.
+			logger.Log(tomon.LevelError, "the connection is closed unexpectedly", "err", err)
+			os.Exit(1)
 		}
 	}
-	bot.Event.OnGuildMemberAdd = func(member *tomon.MemberInfo) {
-		channels, err := bot.ChannelsInGuild(member.GuildID)
+	// Reconnects are already logged by the bot.
+	bot.AddHandler(func(e *tomon.StateChange) {
+		logger.Log(tomon.LevelDebug, "gateway state changed", "from", e.Old.String(), "to", e.New.String())
+	})
+	bot.AddHandler(func(member *tomon.GuildMemberAdd) {
+		ctx, cancel := requestContext()
+		defer cancel()
+		channels, err := bot.ChannelsInGuildCtx(ctx, member.GuildID)
 		if err != nil {
 			return
 		}
 		for channelID := range channels {
 			_ = event.OnMemberJoined(channelID, member.User.ID, "")
 		}
-	}
-	bot.Event.OnGuildMemberRemove = func(member *tomon.MemberInfo) {
-		channels, err := bot.ChannelsInGuild(member.GuildID)
+	})
+	bot.AddHandler(func(member *tomon.GuildMemberRemove) {
+		ctx, cancel := requestContext()
+		defer cancel()
+		channels, err := bot.ChannelsInGuildCtx(ctx, member.GuildID)
 		if err != nil {
 			return
 		}
 		for channelID := range channels {
 			_ = event.OnMemberLeft(channelID, member.User.ID)
 		}
-	}
-	bot.Event.OnMessageCreate = func(msg *tomon.MessageInfo) {
+	})
+	bot.AddHandler(func(e *tomon.MessageReactionAdd) {
+		receiveReaction(&e.MessageReactionInfo, "add")
+	})
+	bot.AddHandler(func(e *tomon.MessageReactionRemove) {
+		receiveReaction(&e.MessageReactionInfo, "remove")
+	})
+	bot.AddHandler(func(msg *tomon.MessageCreate) {
 		if msg.Author == nil {
 			return
 		}
 		if msg.Author.ID == bot.Self().ID {
 			return
 		}
-		ubotMsg := toUBotMessage(msg)
+		ubotMsg := toUBotMessage(&msg.MessageInfo)
 		if ubotMsg == "" {
 			return
 		}
 		info := ubot.MsgInfo{
 			ID: msg.ID,
 		}
-		if msg.ChannelID == nil || *msg.ChannelID == "" || *msg.ChannelID == "0" {
-			_ = event.OnReceiveChatMessage(ubot.PrivateMsg, "", msg.Author.ID, ubotMsg, info)
-		} else {
-			_ = event.OnReceiveChatMessage(ubot.GroupMsg, *msg.ChannelID, msg.Author.ID, ubotMsg, info)
+		atomic.AddUint64(&metrics.received, 1)
+		var channelID string
+		if msg.ChannelID != nil {
+			channelID = *msg.ChannelID
 		}
-	}
+		var guildID string
+		if msg.Member != nil {
+			guildID = msg.Member.GuildID
+		}
+		msgType, source := chatSource(channelID, guildID)
+		_ = event.OnReceiveChatMessage(msgType, source, msg.Author.ID, ubotMsg, info)
+	})
 	return err
 }
+
+// outgoingMessage batches text and the attachments following it into one Tomon message.
+type outgoingMessage struct {
+	ctx       context.Context
+	channelID string
+	text      strings.Builder
+	files     []tomon.ReaderWithName
+	closers   []io.Closer
+	// stamps are sent on their own, without text or files.
+	stamps []string
+	// replyID is used by the next message sent only, so a reply split into several messages is threaded once.
+	replyID string
+	// segment is the index of the entity being added, and segments those of the entities in the pending message.
+	segment  int
+	segments []int
+	failures []*sendFailure
+}
+
+// fail records that the given entities could not be sent.
+func (msg *outgoingMessage) fail(segments []int, reason string, err error) {
+	metrics.sendFailures.inc(label("reason", reason))
+	msg.failures = append(msg.failures, &sendFailure{Segments: segments, Reason: reason, Err: err})
+}
+
+// err returns the failures recorded so far as a *sendError, or nil.
+func (msg *outgoingMessage) err(total int) error {
+	if len(msg.failures) == 0 {
+		return nil
+	}
+	return &sendError{Total: total, Failures: msg.failures}
+}
+
+func (msg *outgoingMessage) writeText(text string) {
+	if len(msg.files) != 0 || len(msg.stamps) != 0 {
+		// Attachments are shown after the content, so text after them goes to the next message.
+		msg.flush()
+	}
+	msg.text.WriteString(text)
+	msg.segments = append(msg.segments, msg.segment)
+}
+
+func (msg *outgoingMessage) attach(file tomon.ReaderWithName, closer io.Closer) {
+	if len(msg.files) == tomon.MaxMessageFiles || len(msg.stamps) != 0 {
+		msg.flush()
+	}
+	file.Reader = countAttachment(file.Reader)
+	msg.files = append(msg.files, file)
+	if closer != nil {
+		msg.closers = append(msg.closers, closer)
+	}
+	msg.segments = append(msg.segments, msg.segment)
+}
+
+func (msg *outgoingMessage) addStamp(stampID string) {
+	if msg.text.Len() != 0 || len(msg.files) != 0 {
+		msg.flush()
+	}
+	msg.stamps = append(msg.stamps, stampID)
+	msg.segments = append(msg.segments, msg.segment)
+}
+
+func (msg *outgoingMessage) flush() {
+	if msg.text.Len() == 0 && len(msg.files) == 0 && len(msg.stamps) == 0 {
+		return
+	}
+	_, err := bot.SendMessageCtx(msg.ctx, msg.channelID, tomon.MessageSend{
+		Content: msg.text.String(),
+		Files:   msg.files,
+		Stamps:  msg.stamps,
+		ReplyID: msg.replyID,
+	})
+	if err == nil {
+		atomic.AddUint64(&metrics.sent, 1)
+	} else {
+		msg.fail(msg.segments, sendFailureReason(err), err)
+	}
+	for _, closer := range msg.closers {
+		closer.Close()
+	}
+	msg.text.Reset()
+	msg.files = nil
+	msg.closers = nil
+	msg.stamps = nil
+	msg.replyID = ""
+	msg.segments = nil
+}
+
 func sendChatMessage(msgType ubot.MsgType, source string, target string, message string) error {
+	atomic.AddInt64(&metrics.pendingSends, 1)
+	defer atomic.AddInt64(&metrics.pendingSends, -1)
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
 	entities := ubot.ParseMsg(message)
-	var builder strings.Builder
-	for _, entity := range entities {
+	channelID := source
+	if msgType == ubot.PrivateMsg {
+		channel, err := bot.CreateDMChannelCtx(ctx, target)
+		if err != nil {
+			// Nothing can be sent without the channel, and there is nowhere to post the notice.
+			msg := &outgoingMessage{}
+			segments := make([]int, len(entities))
+			for i := range segments {
+				segments[i] = i
+			}
+			msg.fail(segments, sendFailureReason(err), fmt.Errorf("failed to open a DM channel with %s: %w", target, err))
+			return msg.err(len(entities))
+		}
+		channelID = channel.ID
+	}
+	msg := &outgoingMessage{ctx: ctx, channelID: channelID}
+	for i, entity := range entities {
+		msg.segment = i
 		switch entity.Type {
 		case "text":
-			builder.WriteString(entity.FirstArgOrEmpty())
+			msg.writeText(entity.FirstArgOrEmpty())
 		case "at":
-			builder.WriteString(fmt.Sprintf("<@%s>", entity.FirstArgOrEmpty()))
+			msg.writeText(fmt.Sprintf("<@%s>", entity.FirstArgOrEmpty()))
 		default:
-			builder.WriteString("[不支持的消息]")
+			msg.writeText("[不支持的消息]")
+		case "reaction":
+			// Reacts to the given message instead of sending anything, or takes the reaction back with action=remove.
+			messageID := entity.NamedArgOr("message", "")
+			if messageID == "" {
+				msg.fail([]int{i}, reasonInvalidData, errors.New("reaction without a message ID"))
+				break
+			}
+			var err error
+			if entity.NamedArgOr("action", "add") == "remove" {
+				err = bot.RemoveReactionCtx(ctx, channelID, messageID, entity.FirstArgOrEmpty(), "")
+			} else {
+				err = bot.AddReactionCtx(ctx, channelID, messageID, entity.FirstArgOrEmpty())
+			}
+			if err != nil {
+				msg.fail([]int{i}, sendFailureReason(err), err)
+			}
+		case "recall":
+			// UBot has no call to recall a message, so it is asked for with an entity like reactions.
+			messageID := entity.FirstArgOrEmpty()
+			if messageID == "" {
+				msg.fail([]int{i}, reasonInvalidData, errors.New("recall without a message ID"))
+				break
+			}
+			if err := bot.DeleteMessageCtx(ctx, channelID, messageID); err != nil {
+				msg.fail([]int{i}, sendFailureReason(err), err)
+			}
+		case "reply":
+			// The reply is lost with the message it threads.
+			msg.replyID = entity.FirstArgOrEmpty()
+			msg.segments = append(msg.segments, msg.segment)
+		case "stamp":
+			if stampID := entity.FirstArgOrEmpty(); stampID != "" {
+				msg.addStamp(stampID)
+			}
 		case "image":
-			if builder.Len() != 0 {
-				_, _ = bot.CreateMessage(source, builder.String())
-				builder.Reset()
+			if stampID := entity.NamedArgOr("stamp", ""); stampID != "" {
+				// An image received from a stamp is sent back as the stamp if the bot has it too. StampCtx
+				// fetches the packs at most once a minute for stamps it does not know.
+				if _, err := bot.StampCtx(ctx, stampID); err == nil {
+					msg.addStamp(stampID)
+					break
+				}
 			}
-			var imageReader io.Reader
-			var imageExt string
 			imageBase64, useBase64 := entity.NamedArgs["base64"]
 			if useBase64 {
 				imageBinary, err := base64.StdEncoding.DecodeString(imageBase64)
 				if err != nil {
+					msg.fail([]int{i}, reasonInvalidData, err)
 					break
 				}
-				imageExt = guessImageExtByBytes(imageBinary, ".png")
-				imageReader = bytes.NewReader(imageBinary)
+				msg.attach(tomon.ReaderWithName{
+					Reader: bytes.NewReader(imageBinary),
+					Size:   int64(len(imageBinary)),
+					Name:   fmt.Sprintf("image-%d%s", time.Now().UnixNano(), guessImageExtByBytes(imageBinary, ".png")),
+				}, nil)
 			} else {
-				resp, err := http.Get(entity.FirstArgOrEmpty())
+				resp, err := download(ctx, entity.FirstArgOrEmpty())
 				if err != nil {
+					msg.fail([]int{i}, reasonDownloadFailed, err)
 					break
 				}
-				imageExt = guessImageExtByMIMEType(resp.Header.Get("Content-Type"), ".png")
-				imageReader = resp.Body
-			}
-			_, _ = bot.CreateAttachmentMessage(source, []tomon.ReaderWithName{{
-				Reader: imageReader,
-				Name:   fmt.Sprintf("image-%d%s", time.Now().UnixNano(), imageExt),
-			}})
-			if imageReadCloser, canClose := imageReader.(io.ReadCloser); canClose {
-				imageReadCloser.Close()
+				msg.attach(tomon.ReaderWithName{
+					Reader: resp.Body,
+					Size:   resp.ContentLength,
+					Name:   fmt.Sprintf("image-%d%s", time.Now().UnixNano(), guessImageExtByMIMEType(resp.Header.Get("Content-Type"), ".png")),
+				}, resp.Body)
 			}
 		case "file":
-			if builder.Len() != 0 {
-				_, _ = bot.CreateMessage(source, builder.String())
-			}
-			builder.Reset()
 			fileName := entity.NamedArgOr("filename", fmt.Sprintf("untitled-file-%d", time.Now().UnixNano()))
-			url := entity.FirstArgOrEmpty()
-			resp, err := http.Get(url)
+			resp, err := download(ctx, entity.FirstArgOrEmpty())
 			if err != nil {
+				msg.fail([]int{i}, reasonDownloadFailed, err)
 				break
 			}
-			defer resp.Body.Close()
-			_, _ = bot.CreateAttachmentMessage(source, []tomon.ReaderWithName{{
+			msg.attach(tomon.ReaderWithName{
 				Reader: resp.Body,
+				Size:   resp.ContentLength,
 				Name:   fileName,
-			}})
+			}, resp.Body)
 		}
 	}
-	if builder.Len() != 0 {
-		_, _ = bot.CreateMessage(source, builder.String())
+	msg.flush()
+	err := msg.err(len(entities))
+	if err != nil {
+		if notice := sendFailureNotice(); notice != "" {
+			// The notice is best effort: its failure would most likely have the same cause.
+			_, _ = bot.SendMessageCtx(ctx, channelID, tomon.MessageSend{Content: notice})
+		}
 	}
-	return nil
+	return err
 }
 
 func removeMember(source string, target string) error {
-	info, err := bot.Channel(source)
+	ctx, cancel := requestContext()
+	defer cancel()
+	info, err := bot.ChannelCtx(ctx, source)
 	if err != nil {
 		return err
 	}
-	return bot.RemoveMember(info.GuildID, target)
+	return bot.RemoveMemberCtx(ctx, info.GuildID, target)
 }
 
 func shutupMember(source string, target string, duration int) error {
@@ -195,7 +517,9 @@ func shutupAllMember(source string, shutupSwitch bool) error {
 }
 
 func getMemberName(source string, target string) (string, error) {
-	info, err := bot.Member(source, target)
+	ctx, cancel := requestContext()
+	defer cancel()
+	info, err := bot.MemberCtx(ctx, source, target)
 	if err != nil {
 		return "", err
 	}
@@ -225,7 +549,7 @@ func getGroupList() ([]string, error) {
 	var r []string
 	channels := bot.Channels()
 	for _, channel := range channels {
-		if channel.Type == 0 {
+		if channel.Type == tomon.ChannelTypeText {
 			r = append(r, channel.ID)
 		}
 	}
@@ -234,7 +558,9 @@ func getGroupList() ([]string, error) {
 
 func getMemberList(id string) ([]string, error) {
 	var r []string
-	channel, err := bot.Channel(id)
+	ctx, cancel := requestContext()
+	defer cancel()
+	channel, err := bot.ChannelCtx(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -258,7 +584,7 @@ func main() {
 	}
 	err = login(loginInfo)
 	if err != nil {
-		fmt.Println("Failed to login to tomon:", err)
+		logger.Log(tomon.LevelError, "failed to login to tomon", "err", err)
 		os.Exit(111)
 	}
 	err = ubot.HostAccount("Tomon Bot", func(e *ubot.AccountEventEmitter) *ubot.Account {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+	ubot "github.com/UBotPlatform/UBot.Common.Go"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestToUBotMessageReplyQuotingAMention(t *testing.T) {
+	mentioned := tomon.UserInfo{ID: "123"}
+	msg := &tomon.MessageInfo{
+		ID:       "2",
+		Content:  stringPtr("<@123> see [this]"),
+		Mentions: []tomon.UserInfo{mentioned},
+		Reply: &tomon.MessageInfo{
+			ID:      "1",
+			Author:  &tomon.UserInfo{ID: "456"},
+			Content: stringPtr("hi <@123> there"),
+		},
+	}
+	entities := ubot.ParseMsg(toUBotMessage(msg))
+	want := []ubot.MsgEntity{
+		{Type: "reply", Args: []string{"1"}, NamedArgs: map[string]string{"author": "456", "text": "hi <@123> there"}},
+		{Type: "at", Args: []string{"123"}},
+		{Type: "text", Args: []string{" see [this]"}},
+	}
+	if len(entities) != len(want) {
+		t.Fatalf("parsed %+v, want %+v", entities, want)
+	}
+	for i := range want {
+		if entities[i].Type != want[i].Type || !reflect.DeepEqual(entities[i].Args, want[i].Args) ||
+			(len(want[i].NamedArgs) != 0 && !reflect.DeepEqual(entities[i].NamedArgs, want[i].NamedArgs)) {
+			t.Errorf("entity %d is %+v, want %+v", i, entities[i], want[i])
+		}
+	}
+}
+
+// connectTestBot points bot at a fake Tomon server for the duration of the test.
+func connectTestBot(t *testing.T) *tomontest.Server {
+	t.Helper()
+	server := tomontest.NewServer()
+	var err error
+	bot, err = tomon.NewWithOptions(&tomon.LoginByToken{Token: server.Token}, server.Options())
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bot.Close()
+		server.Close()
+	})
+	return server
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte(`{"code":50013,"message":"Missing Permissions"}`))
+}
+
+func TestSendChatMessageReportsLostSegments(t *testing.T) {
+	server := connectTestBot(t)
+
+	server.HandleFunc("POST", "/users/@me/channels", forbidden)
+	err := sendChatMessage(ubot.PrivateMsg, "", "30", "hello[reply:1]")
+	var dmError *sendError
+	if !errors.As(err, &dmError) || dmError.Total != 2 || len(dmError.Failures) != 1 ||
+		!reflect.DeepEqual(dmError.Failures[0].Segments, []int{0, 1}) || dmError.Failures[0].Reason != reasonPermissionDenied {
+		t.Errorf("opening the DM channel failed with %v, want every segment lost for lack of permission", err)
+	}
+
+	server.HandleFunc("POST", "/channels/{channel}/messages", forbidden)
+	err = sendChatMessage(ubot.GroupMsg, "20", "", "[reply:1]hello")
+	var replyError *sendError
+	if !errors.As(err, &replyError) || len(replyError.Failures) != 1 || !reflect.DeepEqual(replyError.Failures[0].Segments, []int{0, 1}) {
+		t.Errorf("a failed reply returned %v, want the reply and its text lost", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+)
+
+// metricsAddrEnv enables the metrics listener, e.g. TOMON_METRICS_ADDR=127.0.0.1:9464.
+// Metrics are served in the Prometheus text format at /metrics.
+const metricsAddrEnv = "TOMON_METRICS_ADDR"
+
+type labelCounter struct {
+	mux    sync.Mutex
+	values map[string]uint64
+}
+
+func (c *labelCounter) inc(labels string) {
+	c.mux.Lock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[labels]++
+	c.mux.Unlock()
+}
+
+func (c *labelCounter) write(w io.Writer, name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, key, c.values[key])
+	}
+}
+
+type metricSet struct {
+	gatewayEvents   labelCounter
+	restCalls       labelCounter
+	sendFailures    labelCounter
+	received        uint64
+	sent            uint64
+	pendingSends    int64
+	attachmentBytes uint64
+}
+
+var metrics metricSet
+
+func label(name string, value string) string {
+	return name + "=" + strconv.Quote(value)
+}
+
+// metricsTransport counts every REST call the bot makes by method, route and status.
+type metricsTransport struct {
+	baseURL string
+	next    http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	endpoint := strings.TrimPrefix(req.URL.String(), t.baseURL)
+	if endpoint == req.URL.String() {
+		endpoint = req.URL.Path
+	}
+	metrics.restCalls.inc(label("method", req.Method) + "," + label("route", tomon.Route(endpoint)) + "," + label("status", status))
+	return resp, err
+}
+
+// countingReader counts the bytes of attachments read while they are uploaded.
+type countingReader struct {
+	io.Reader
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddUint64(&metrics.attachmentBytes, uint64(n))
+	return n, err
+}
+
+// seekingCountingReader keeps an attachment seekable, so that its upload can be sent again after a 429.
+type seekingCountingReader struct {
+	countingReader
+	seeker io.Seeker
+}
+
+func (r seekingCountingReader) Seek(offset int64, whence int) (int64, error) {
+	return r.seeker.Seek(offset, whence)
+}
+
+// countAttachment wraps r to count the bytes read from it, keeping it an io.Seeker if it is one.
+func countAttachment(r io.Reader) io.Reader {
+	if seeker, ok := r.(io.Seeker); ok {
+		return seekingCountingReader{countingReader{r}, seeker}
+	}
+	return countingReader{r}
+}
+
+// metricsOptions returns the options to create the bot with, counting REST calls if metrics are enabled.
+func metricsOptions(options tomon.Options) tomon.Options {
+	if os.Getenv(metricsAddrEnv) != "" {
+		baseURL := options.BaseURL
+		if baseURL == "" {
+			baseURL = tomon.BaseURL
+		}
+		options.HTTPClient = &http.Client{Transport: metricsTransport{baseURL: baseURL, next: http.DefaultTransport}}
+	}
+	return options
+}
+
+// serveMetrics starts the metrics listener if it is enabled.
+func serveMetrics() {
+	addr := os.Getenv(metricsAddrEnv)
+	if addr == "" {
+		return
+	}
+	bot.AddHandler(func(e *tomon.RawDispatch) {
+		metrics.gatewayEvents.inc(label("type", e.Name))
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		logger.Log(tomon.LevelError, "metrics listener stopped", "addr", addr, "err", err)
+	}()
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	stats := bot.Stats()
+
+	fmt.Fprintln(w, "# HELP tomon_gateway_events_total Gateway dispatch events received, by type.")
+	fmt.Fprintln(w, "# TYPE tomon_gateway_events_total counter")
+	metrics.gatewayEvents.write(w, "tomon_gateway_events_total")
+	fmt.Fprintln(w, "# HELP tomon_rest_requests_total REST calls made, by method, route and status.")
+	fmt.Fprintln(w, "# TYPE tomon_rest_requests_total counter")
+	metrics.restCalls.write(w, "tomon_rest_requests_total")
+	fmt.Fprintln(w, "# HELP tomon_send_failures_total Parts of outgoing chat messages that could not be sent, by reason.")
+	fmt.Fprintln(w, "# TYPE tomon_send_failures_total counter")
+	metrics.sendFailures.write(w, "tomon_send_failures_total")
+
+	fmt.Fprintln(w, "# HELP tomon_messages_received_total Chat messages forwarded to UBot.")
+	fmt.Fprintln(w, "# TYPE tomon_messages_received_total counter")
+	fmt.Fprintln(w, "tomon_messages_received_total", atomic.LoadUint64(&metrics.received))
+	fmt.Fprintln(w, "# HELP tomon_messages_sent_total Messages created on Tomon.")
+	fmt.Fprintln(w, "# TYPE tomon_messages_sent_total counter")
+	fmt.Fprintln(w, "tomon_messages_sent_total", atomic.LoadUint64(&metrics.sent))
+	fmt.Fprintln(w, "# HELP tomon_outbound_queue_depth Chat messages from UBot being sent.")
+	fmt.Fprintln(w, "# TYPE tomon_outbound_queue_depth gauge")
+	fmt.Fprintln(w, "tomon_outbound_queue_depth", atomic.LoadInt64(&metrics.pendingSends))
+	fmt.Fprintln(w, "# HELP tomon_attachment_uploaded_bytes_total Bytes of attachments uploaded.")
+	fmt.Fprintln(w, "# TYPE tomon_attachment_uploaded_bytes_total counter")
+	fmt.Fprintln(w, "tomon_attachment_uploaded_bytes_total", atomic.LoadUint64(&metrics.attachmentBytes))
+
+	fmt.Fprintln(w, "# HELP tomon_gateway_ready Whether the gateway connection is ready.")
+	fmt.Fprintln(w, "# TYPE tomon_gateway_ready gauge")
+	ready := 0
+	if stats.State == tomon.StateReady {
+		ready = 1
+	}
+	fmt.Fprintln(w, "tomon_gateway_ready", ready)
+	fmt.Fprintln(w, "# HELP tomon_gateway_reconnect_attempts_total Times the gateway connection was lost or could not be established.")
+	fmt.Fprintln(w, "# TYPE tomon_gateway_reconnect_attempts_total counter")
+	fmt.Fprintln(w, "tomon_gateway_reconnect_attempts_total", stats.ReconnectAttempts)
+	fmt.Fprintln(w, "# HELP tomon_gateway_reconnects_total Times the gateway connection came back.")
+	fmt.Fprintln(w, "# TYPE tomon_gateway_reconnects_total counter")
+	fmt.Fprintln(w, "tomon_gateway_reconnects_total", stats.Reconnects)
+	fmt.Fprintln(w, "# HELP tomon_gateway_missed_acks_total Heartbeats not acknowledged in time.")
+	fmt.Fprintln(w, "# TYPE tomon_gateway_missed_acks_total counter")
+	fmt.Fprintln(w, "tomon_gateway_missed_acks_total", stats.MissedAcks)
+	fmt.Fprintln(w, "# HELP tomon_gateway_heartbeat_rtt_seconds Round trip time of the heartbeats.")
+	fmt.Fprintln(w, "# TYPE tomon_gateway_heartbeat_rtt_seconds histogram")
+	for _, bucket := range stats.HeartbeatRTTTotal.Buckets {
+		fmt.Fprintf(w, "tomon_gateway_heartbeat_rtt_seconds_bucket{le=\"%g\"} %d\n", bucket.UpperBound.Seconds(), bucket.Count)
+	}
+	fmt.Fprintf(w, "tomon_gateway_heartbeat_rtt_seconds_bucket{le=\"+Inf\"} %d\n", stats.HeartbeatRTTTotal.Count)
+	fmt.Fprintf(w, "tomon_gateway_heartbeat_rtt_seconds_sum %g\n", stats.HeartbeatRTTTotal.Sum.Seconds())
+	fmt.Fprintf(w, "tomon_gateway_heartbeat_rtt_seconds_count %d\n", stats.HeartbeatRTTTotal.Count)
+
+	fmt.Fprintln(w, "# HELP tomon_rest_rate_limited_total REST calls rejected with 429.")
+	fmt.Fprintln(w, "# TYPE tomon_rest_rate_limited_total counter")
+	fmt.Fprintln(w, "tomon_rest_rate_limited_total", stats.RateLimit.Throttled)
+	fmt.Fprintln(w, "# HELP tomon_rest_retries_total REST calls retried after a rate limit.")
+	fmt.Fprintln(w, "# TYPE tomon_rest_retries_total counter")
+	fmt.Fprintln(w, "tomon_rest_retries_total", stats.RateLimit.Retried)
+}
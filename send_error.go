@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+)
+
+// sendFailureNoticeEnv sets a text posted to the channel when part of a message could not be sent,
+// e.g. TOMON_SEND_FAILURE_NOTICE="[部分消息发送失败]". Nothing is posted if it is empty.
+const sendFailureNoticeEnv = "TOMON_SEND_FAILURE_NOTICE"
+
+// Reasons of a sendFailure.
+const (
+	reasonDownloadFailed   = "download failed"
+	reasonInvalidData      = "invalid data"
+	reasonUploadRejected   = "upload rejected"
+	reasonPermissionDenied = "permission denied"
+	reasonRateLimited      = "rate limited"
+	reasonTimedOut         = "timed out"
+	reasonSendFailed       = "send failed"
+)
+
+// sendFailure tells why some segments of a UBot message could not be delivered.
+type sendFailure struct {
+	// Segments are the indexes of the entities of the message that were lost, starting at 0.
+	Segments []int
+	Reason   string
+	Err      error
+}
+
+func (f *sendFailure) Error() string {
+	segments := make([]string, len(f.Segments))
+	for i, segment := range f.Segments {
+		segments[i] = strconv.Itoa(segment)
+	}
+	noun := "segment"
+	if len(segments) > 1 {
+		noun = "segments"
+	}
+	return fmt.Sprintf("%s %s: %s: %v", noun, strings.Join(segments, ","), f.Reason, f.Err)
+}
+
+func (f *sendFailure) Unwrap() error {
+	return f.Err
+}
+
+// sendError is returned to UBot when some segments of a message could not be delivered.
+type sendError struct {
+	Total    int
+	Failures []*sendFailure
+}
+
+func (e *sendError) Error() string {
+	lost := 0
+	messages := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		lost += len(f.Segments)
+		messages[i] = f.Error()
+	}
+	return fmt.Sprintf("failed to send %d of %d segments: %s", lost, e.Total, strings.Join(messages, "; "))
+}
+
+// sendFailureReason classifies an error returned by the Tomon client.
+func sendFailureReason(err error) string {
+	var apiError *tomon.APIError
+	switch {
+	case errors.Is(err, tomon.ErrUploadTooLarge):
+		return reasonUploadRejected
+	case errors.As(err, &apiError) && apiError.StatusCode == http.StatusRequestEntityTooLarge:
+		return reasonUploadRejected
+	case tomon.IsForbidden(err) || tomon.IsUnauthorized(err):
+		return reasonPermissionDenied
+	case tomon.IsRateLimited(err):
+		return reasonRateLimited
+	case errors.Is(err, context.DeadlineExceeded):
+		return reasonTimedOut
+	}
+	return reasonSendFailed
+}
+
+func sendFailureNotice() string {
+	return os.Getenv(sendFailureNoticeEnv)
+}
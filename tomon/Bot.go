@@ -2,12 +2,11 @@ package tomon
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"mime/multipart"
 	"net/http"
 	"sync"
 	"sync/atomic"
@@ -19,69 +18,156 @@ import (
 const BaseURL = "https://beta.tomon.co/api/v1"
 const GatewayURL = "wss://gateway.tomon.co"
 
-func fullURL(endpoint string) string {
-	return BaseURL + endpoint
+const resumeTimeout = 10 * time.Second
+
+// defaultHeartbeatInterval is used when HELLO does not announce a usable heartbeat interval.
+const defaultHeartbeatInterval = 10 * time.Second
+
+func (bot *Bot) fullURL(endpoint string) string {
+	return bot.options.BaseURL + endpoint
+}
+
+func (bot *Bot) header() http.Header {
+	header := make(http.Header)
+	if bot.options.UserAgent != "" {
+		header.Set("User-Agent", bot.options.UserAgent)
+	}
+	return header
 }
 
 type Bot struct {
-	token             string
-	self              UserInfo
-	gateway           *websocket.Conn
-	lastPong          time.Time
-	heartbeatInterval time.Duration
-	heartbeatTaskId   int32
-	closed            bool
-	mux               sync.Mutex
-	state             struct {
-		Guilds          map[string]GuildInfo             //[GuildID]
-		Channels        map[string]ChannelInfo           //[ChannelID]
-		Members         map[string]map[string]MemberInfo //[GuildID][MemberID]
-		ChannelsInGuild map[string]map[string]int
-	}
-	Event struct {
+	options         Options
+	limiter         *rateLimiter
+	store           *stateStore
+	events          eventBus
+	token           string
+	self            UserInfo
+	gateway         *websocket.Conn
+	stats           gatewayStats
+	catchUp         catchUp
+	stamps          stampCache
+	heartbeatTaskId int32
+	connectionState int32
+	session         struct {
+		ID       string // ID of the session to resume on reconnect, empty if there is none
+		HelloID  string // session ID announced by HELLO on the current connection
+		Sequence int64  // sequence number of the last dispatch received
+	}
+	closed bool
+	done   chan struct{} // closed together with closed being set
+	mux    sync.Mutex    // guards writes to the gateway and closed
+	Event  struct {
 		// OnClose is called when the connection to the gateway is closed. err is nil if the connection was closed by user.
-		OnClose             func(err error)
-		OnGuildCreate       func(info *GuildInfo)
-		OnGuildDelete       func(info *GuildInfo)
-		OnGuildUpdate       func(info *GuildInfo)
-		OnChannelCreate     func(info *ChannelInfo)
-		OnChannelDelete     func(info *ChannelInfo)
-		OnChannelUpdate     func(info *ChannelInfo)
-		OnGuildMemberAdd    func(info *MemberInfo)
-		OnGuildMemberRemove func(info *MemberInfo)
-		OnGuildMemberUpdate func(info *MemberInfo)
-		OnMessageCreate     func(info *MessageInfo)
-		OnMessageDelete     func(info *MessageInfo)
-		OnMessageUpdate     func(info *MessageInfo)
+		OnClose func(err error)
+		// OnReconnecting is called before waiting delay to connect to the gateway again.
+		OnReconnecting func(attempt int, delay time.Duration)
+		// OnReconnected is called once the connection to the gateway is back.
+		OnReconnected func()
+		// OnStateChange is called whenever the gateway connection moves to another state.
+		OnStateChange func(old ConnectionState, new ConnectionState)
+		// OnRawOp is called for every frame received from the gateway, before it is handled.
+		OnRawOp func(op int, data json.RawMessage)
+		// OnRawDispatch is called for every DISPATCH frame, including unknown events, before it is handled.
+		OnRawDispatch           func(name string, data json.RawMessage)
+		OnGuildCreate           func(info *GuildInfo)
+		OnGuildDelete           func(info *GuildInfo)
+		OnGuildUpdate           func(info *GuildInfo)
+		OnChannelCreate         func(info *ChannelInfo)
+		OnChannelDelete         func(info *ChannelInfo)
+		OnChannelUpdate         func(info *ChannelInfo)
+		OnGuildMemberAdd        func(info *MemberInfo)
+		OnGuildMemberRemove     func(info *MemberInfo)
+		OnGuildMemberUpdate     func(info *MemberInfo)
+		OnMessageCreate         func(info *MessageInfo)
+		OnMessageDelete         func(info *MessageInfo)
+		OnMessageUpdate         func(info *MessageInfo)
+		OnMessageReactionAdd    func(info *MessageReactionInfo)
+		OnMessageReactionRemove func(info *MessageReactionInfo)
 	}
 }
 
+// RawREST sends a request to the REST API and decodes the JSON response into response if it is not nil.
+// Requests are queued per route and sent again after a 429 response as long as content can be replayed.
 func (bot *Bot) RawREST(method string, endpoint string, contentType string, content io.Reader, response interface{}) error {
-	var err error
-	req, err := http.NewRequest(method, fullURL(endpoint), content)
+	return bot.RawRESTCtx(context.Background(), method, endpoint, contentType, content, response)
+}
+
+// RawRESTCtx is like RawREST but gives up waiting in the queue or for the response once ctx is done.
+func (bot *Bot) RawRESTCtx(ctx context.Context, method string, endpoint string, contentType string, content io.Reader, response interface{}) error {
+	route := method + " " + routeOf(endpoint)
+	bucket := bot.limiter.bucket(route)
+	err := bucket.acquire(ctx)
 	if err != nil {
 		return err
 	}
+	defer bucket.release()
+	replay := replayable(content)
+	for attempt := 0; ; attempt++ {
+		if d := bot.limiter.delay(bucket); d > 0 {
+			err = sleepContext(ctx, d)
+			if err != nil {
+				return err
+			}
+		}
+		if attempt != 0 {
+			content = replay()
+		}
+		retryAfter, err := bot.sendREST(ctx, bucket, route, method, endpoint, contentType, content, response)
+		if retryAfter < 0 {
+			return err
+		}
+		if replay == nil || attempt >= bot.options.MaxRateLimitRetries {
+			return err
+		}
+		atomic.AddUint64(&bot.limiter.retried, 1)
+	}
+}
+
+// sendREST sends a single request. retryAfter is non-negative if the request was rate limited.
+func (bot *Bot) sendREST(ctx context.Context, bucket *rateBucket, route string, method string, endpoint string, contentType string, content io.Reader, response interface{}) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, bot.fullURL(endpoint), content)
+	if err != nil {
+		return -1, err
+	}
+	if sized, ok := content.(interface{ contentLength() int64 }); ok && sized.contentLength() >= 0 {
+		req.ContentLength = sized.contentLength()
+	}
+	req.Header = bot.header()
 	req.Header.Add("Content-Type", contentType)
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", bot.token))
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := bot.options.HTTPClient.Do(req)
 	if err != nil {
-		return err
+		return -1, err
 	}
 	defer resp.Body.Close()
+	bot.limiter.update(bucket, resp.Header)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		body := readErrorBody(resp.Body)
+		return bot.limiter.throttle(bucket, route, resp, body), newAPIError(method, endpoint, resp, body)
+	}
 	if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		return fmt.Errorf("failed to send REST request: %s", resp.Status)
+		return -1, newAPIError(method, endpoint, resp, readErrorBody(resp.Body))
 	}
 	if response != nil {
 		err = json.NewDecoder(resp.Body).Decode(&response)
 		if err != nil {
-			return err
+			return -1, err
 		}
 	}
-	return nil
+	return -1, nil
+}
+
+// RateLimitStats returns how often REST requests have been throttled so far.
+func (bot *Bot) RateLimitStats() RateLimitStats {
+	return bot.limiter.stats()
 }
 
 func (bot *Bot) REST(method string, endpoint string, request interface{}, response interface{}) error {
+	return bot.RESTCtx(context.Background(), method, endpoint, request, response)
+}
+
+// RESTCtx is like REST but carries ctx down to the HTTP request.
+func (bot *Bot) RESTCtx(ctx context.Context, method string, endpoint string, request interface{}, response interface{}) error {
 	var requestBody []byte
 	var err error
 	if request != nil {
@@ -92,30 +178,41 @@ func (bot *Bot) REST(method string, endpoint string, request interface{}, respon
 	} else {
 		requestBody = make([]byte, 0)
 	}
-	return bot.RawREST(method, endpoint, "application/json", bytes.NewReader(requestBody), response)
+	return bot.RawRESTCtx(ctx, method, endpoint, "application/json", bytes.NewReader(requestBody), response)
 }
 func New(payload LoginInfo) (*Bot, error) {
+	return NewWithOptions(payload, Options{})
+}
+func NewWithOptions(payload LoginInfo, options Options) (*Bot, error) {
 	var err error
 	var result loginResult
-	buf := payload.Body()
-	resp, err := http.Post(fullURL("/auth/login"), "application/json", bytes.NewBuffer(buf))
+	var bot = &Bot{
+		options: options.withDefaults(),
+		limiter: newRateLimiter(),
+		store:   newStateStore(),
+		done:    make(chan struct{}),
+	}
+	bot.events.logger = bot.options.Logger
+	req, err := http.NewRequest("POST", bot.fullURL("/auth/login"), bytes.NewReader(payload.Body()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = bot.header()
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := bot.options.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to login: %s", resp.Status)
+		return nil, fmt.Errorf("failed to login: %w", newAPIError("POST", "/auth/login", resp, readErrorBody(resp.Body)))
 	}
 	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
 		return nil, fmt.Errorf("failed to login: %w", err)
 	}
-	var bot = &Bot{
-		token:    result.Token,
-		self:     result.UserInfo,
-		lastPong: time.Now(),
-	}
-	bot.resetState()
+	bot.token = result.Token
+	bot.self = result.UserInfo
 	completion := make(chan error)
 	go bot.connectToGateway(completion)
 	err = <-completion
@@ -128,54 +225,100 @@ func New(payload LoginInfo) (*Bot, error) {
 func (bot *Bot) connectToGateway(completion chan error) {
 	var completionNotifier sync.Once
 	var lastError error
-	for retryIndex := 0; retryIndex < 5; retryIndex++ {
+	var connected int32
+	failures := 0
+	for {
 		lastError = func() error {
 			defer func() {
 				if err := recover(); err != nil {
-					log.Println("An error occurred:", err)
+					bot.options.Logger.Log(LevelError, "panic while connecting to gateway", "panic", fmt.Sprint(err))
 				}
 			}()
-			gateway, _, err := websocket.DefaultDialer.Dial(GatewayURL, nil)
+			bot.setState(StateConnecting)
+			defer bot.setState(StateDisconnected)
+			gateway, _, err := bot.options.Dialer.Dial(bot.options.GatewayURL, bot.header())
 			if err != nil {
 				return err
 			}
+			bot.mux.Lock()
 			bot.gateway = gateway
-			err = bot.gatewayIdentity()
+			bot.mux.Unlock()
+			resuming := bot.session.ID != ""
+			if resuming {
+				bot.setState(StateResuming)
+				err = bot.gatewayResume()
+			} else {
+				bot.setState(StateIdentifying)
+				err = bot.gatewayIdentity()
+			}
 			if err != nil {
 				return err
 			}
-			identified := false
+			var identified int32
+			if resuming {
+				// Give up on a gateway that neither resumes nor rejects the session.
+				resumeTimer := time.AfterFunc(resumeTimeout, func() {
+					if atomic.LoadInt32(&identified) == 0 {
+						_ = gateway.Close()
+					}
+				})
+				defer resumeTimer.Stop()
+			}
 			err = bot.receiveNotification(func() {
 				completionNotifier.Do(func() {
 					completion <- nil
 				})
-				identified = true
+				atomic.StoreInt32(&identified, 1)
+				bot.setState(StateReady)
+				if !atomic.CompareAndSwapInt32(&connected, 0, 1) {
+					bot.stats.reconnected()
+					bot.emit(&Reconnected{})
+				}
 			})
-			if identified {
+			if atomic.LoadInt32(&identified) != 0 {
 				return nil
 			}
+			if resuming {
+				bot.session.ID = ""
+			}
 			return err
 		}()
 		if lastError == nil {
-			retryIndex = 0
+			failures = 0
+		} else {
+			failures++
+		}
+		if bot.isClosed() {
+			break
+		}
+		policy := bot.options.ReconnectPolicy
+		if maxAttempts := policy.maxAttempts(atomic.LoadInt32(&connected) != 0); maxAttempts > 0 && failures >= maxAttempts {
+			break
+		}
+		delay := policy.delay(failures)
+		bot.stats.reconnecting()
+		bot.options.Logger.Log(LevelInfo, "gateway disconnected, reconnecting", "err", lastError, "attempt", failures+1, "delay", delay)
+		bot.emit(&Reconnecting{Attempt: failures + 1, Delay: delay})
+		select {
+		case <-time.After(delay):
+		case <-bot.done:
 		}
-		if bot.closed {
+		if bot.isClosed() {
 			break
 		}
-		time.Sleep(3 * time.Second)
 	}
 	raiseClose := false
 	bot.mux.Lock()
 	if !bot.closed {
 		bot.closed = true
+		close(bot.done)
 		raiseClose = true
 	}
 	bot.mux.Unlock()
-	closeError := fmt.Errorf("failed to connect to gateway after 5 attempts, last error: %w", lastError)
+	bot.setState(StateClosed)
+	closeError := fmt.Errorf("failed to connect to gateway after %d attempts, last error: %w", failures, lastError)
 	if raiseClose {
-		if bot.Event.OnClose != nil {
-			bot.Event.OnClose(closeError)
-		}
+		bot.emit(&Close{Err: closeError})
 	}
 	completionNotifier.Do(func() {
 		completion <- closeError
@@ -183,6 +326,7 @@ func (bot *Bot) connectToGateway(completion chan error) {
 }
 
 func (bot *Bot) receiveNotification(identified func()) error {
+	var heartbeatInterval time.Duration
 	for {
 		var n gatewayNotification
 		_, content, err := bot.gateway.ReadMessage()
@@ -191,153 +335,143 @@ func (bot *Bot) receiveNotification(identified func()) error {
 		}
 		err = json.Unmarshal(content, &n)
 		if err != nil {
-			log.Println("invaild notification:", err)
+			bot.logInvalidPayload("invalid gateway frame", err, "", content)
 			continue
 		}
+		bot.emit(&RawOp{Op: n.Op, Data: n.D})
+		if n.Op == 0 {
+			bot.emit(&RawDispatch{Name: n.E, Data: n.D})
+		}
 		switch n.Op {
 		case 0: //DISPATCH
+			if n.S > bot.session.Sequence {
+				bot.session.Sequence = n.S
+			}
 			switch n.E {
 			case "GUILD_CREATE":
-				var data GuildInfo
+				var data GuildCreate
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild GUILD_CREATE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "GUILD_CREATE", n.D)
 					break
 				}
-				bot.state.Guilds[data.ID] = data
-				if bot.Event.OnGuildCreate != nil {
-					bot.Event.OnGuildCreate(&data)
-				}
+				bot.store.setGuild(data.GuildInfo)
+				bot.emit(&data)
 			case "GUILD_UPDATE":
-				var data GuildInfo
+				var data GuildUpdate
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild GUILD_UPDATE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "GUILD_UPDATE", n.D)
 					break
 				}
-				bot.state.Guilds[data.ID] = data
-				if bot.Event.OnGuildUpdate != nil {
-					bot.Event.OnGuildUpdate(&data)
-				}
+				bot.store.setGuild(data.GuildInfo)
+				bot.emit(&data)
 			case "GUILD_DELETE":
-				var data GuildInfo
+				var data GuildDelete
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild GUILD_DELETE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "GUILD_DELETE", n.D)
 					break
 				}
-				if bot.Event.OnGuildDelete != nil {
-					bot.Event.OnGuildDelete(&data)
-				}
-				delete(bot.state.Guilds, data.ID)
-				delete(bot.state.ChannelsInGuild, data.ID)
+				bot.emit(&data)
+				bot.store.removeGuild(data.ID)
 			case "CHANNEL_CREATE":
-				var data ChannelInfo
+				var data ChannelCreate
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild CHANNEL_CREATE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "CHANNEL_CREATE", n.D)
 					break
 				}
-				bot.state.Channels[data.ID] = data
-				cpg, ok := bot.state.ChannelsInGuild[data.GuildID]
-				if !ok {
-					cpg = make(map[string]int)
-					bot.state.ChannelsInGuild[data.GuildID] = cpg
-				}
-				cpg[data.ID] = 0
-				if bot.Event.OnChannelCreate != nil {
-					bot.Event.OnChannelCreate(&data)
-				}
+				bot.store.setChannel(data.ChannelInfo)
+				bot.emit(&data)
 			case "CHANNEL_UPDATE":
-				var data ChannelInfo
+				var data ChannelUpdate
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild CHANNEL_UPDATE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "CHANNEL_UPDATE", n.D)
 					break
 				}
-				bot.state.Channels[data.ID] = data
-				if bot.Event.OnChannelUpdate != nil {
-					bot.Event.OnChannelUpdate(&data)
-				}
+				bot.store.setChannel(data.ChannelInfo)
+				bot.emit(&data)
 			case "CHANNEL_DELETE":
-				var data ChannelInfo
+				var data ChannelDelete
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild CHANNEL_DELETE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "CHANNEL_DELETE", n.D)
 					break
 				}
-				if bot.Event.OnChannelDelete != nil {
-					bot.Event.OnChannelDelete(&data)
-				}
-				delete(bot.state.Channels, data.ID)
-				cpg, ok := bot.state.ChannelsInGuild[data.GuildID]
-				if ok {
-					delete(cpg, data.ID)
-				}
+				bot.emit(&data)
+				bot.store.removeChannel(data.ChannelInfo)
 			case "GUILD_MEMBER_ADD":
-				var data MemberInfo
+				var data GuildMemberAdd
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild GUILD_MEMBER_ADD notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "GUILD_MEMBER_ADD", n.D)
 					break
 				}
-				bot.Members(data.GuildID)[data.User.ID] = data
-				if bot.Event.OnGuildMemberAdd != nil {
-					bot.Event.OnGuildMemberAdd(&data)
-				}
+				bot.store.setMember(data.MemberInfo)
+				bot.emit(&data)
 			case "GUILD_MEMBER_UPDATE":
-				var data MemberInfo
+				var data GuildMemberUpdate
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild GUILD_MEMBER_UPDATE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "GUILD_MEMBER_UPDATE", n.D)
 					break
 				}
-				bot.Members(data.GuildID)[data.User.ID] = data
-				if bot.Event.OnGuildMemberUpdate != nil {
-					bot.Event.OnGuildMemberUpdate(&data)
-				}
+				bot.store.setMember(data.MemberInfo)
+				bot.emit(&data)
 			case "GUILD_MEMBER_REMOVE":
-				var data MemberInfo
+				var data GuildMemberRemove
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild GUILD_MEMBER_REMOVE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "GUILD_MEMBER_REMOVE", n.D)
 					break
 				}
-				if bot.Event.OnGuildMemberRemove != nil {
-					bot.Event.OnGuildMemberRemove(&data)
-				}
-				delete(bot.Members(data.GuildID), data.User.ID)
-
+				bot.emit(&data)
+				bot.store.removeMember(data.GuildID, data.User.ID)
 			case "MESSAGE_CREATE":
-				var data MessageInfo
+				var data MessageCreate
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild MESSAGE_CREATE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "MESSAGE_CREATE", n.D)
 					break
 				}
-				if bot.Event.OnMessageCreate != nil {
-					bot.Event.OnMessageCreate(&data)
+				if !bot.catchUp.deliver(&data.MessageInfo) {
+					break
 				}
+				bot.emit(&data)
 			case "MESSAGE_UPDATE":
-				var data MessageInfo
+				var data MessageUpdate
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild MESSAGE_UPDATE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "MESSAGE_UPDATE", n.D)
 					break
 				}
-				if bot.Event.OnMessageUpdate != nil {
-					bot.Event.OnMessageUpdate(&data)
-				}
+				bot.emit(&data)
 			case "MESSAGE_DELETE":
-				var data MessageInfo
+				var data MessageDelete
 				err = json.Unmarshal(n.D, &data)
 				if err != nil {
-					log.Println("invaild MESSAGE_DELETE notification:", err, string(n.D))
+					bot.logInvalidPayload("invalid notification", err, "MESSAGE_DELETE", n.D)
 					break
 				}
-				if bot.Event.OnMessageDelete != nil {
-					bot.Event.OnMessageDelete(&data)
+				bot.emit(&data)
+			case "MESSAGE_REACTION_ADD":
+				var data MessageReactionAdd
+				err = json.Unmarshal(n.D, &data)
+				if err != nil {
+					bot.logInvalidPayload("invalid notification", err, "MESSAGE_REACTION_ADD", n.D)
+					break
+				}
+				bot.emit(&data)
+			case "MESSAGE_REACTION_REMOVE":
+				var data MessageReactionRemove
+				err = json.Unmarshal(n.D, &data)
+				if err != nil {
+					bot.logInvalidPayload("invalid notification", err, "MESSAGE_REACTION_REMOVE", n.D)
+					break
 				}
+				bot.emit(&data)
 			}
 		case 1: //HEARTBEAT
 			_ = bot.gatewayPong()
@@ -345,80 +479,137 @@ func (bot *Bot) receiveNotification(identified func()) error {
 			var data identityNotification
 			err = json.Unmarshal(n.D, &data)
 			if err != nil {
-				log.Println("invaild identity notification:", err)
+				bot.logInvalidPayload("invalid identity notification", err, "", n.D)
 				_ = bot.gateway.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, ""))
 				return fmt.Errorf("invaild identity notification: %w", err)
 			}
-			bot.resetState()
-			for _, dmChannel := range data.DMChannels {
-				bot.state.Channels[dmChannel.ID] = dmChannel
-			}
-			for _, guild := range data.Guilds {
-				bot.state.Guilds[guild.ID] = guild.GuildInfo
-				for _, channel := range guild.Channels {
-					bot.state.Channels[channel.ID] = channel
-				}
-				memberSubMap := bot.Members(guild.ID)
-				for _, member := range guild.Members {
-					memberSubMap[member.User.ID] = member
-				}
+			bot.session.ID = bot.session.HelloID
+			bot.session.Sequence = 0
+			var baseline map[string]string
+			if bot.options.CatchUpMessages > 0 {
+				baseline = bot.catchUp.baseline(bot.store.allChannels())
 			}
+			bot.store.load(&data)
 			identified()
+			if len(baseline) != 0 {
+				bot.catchUpMessages(baseline, heartbeatInterval)
+			}
 		case 3: //HELLO
 			var data helloNotification
 			err = json.Unmarshal(n.D, &data)
 			if err != nil {
-				log.Println("invaild hello notification:", err)
-				log.Println("fallback: set heartbeat interval to 10 seconds")
-				bot.heartbeatInterval = 10 * time.Second
+				bot.logInvalidPayload("invalid hello notification, falling back to a 10s heartbeat interval", err, "", n.D)
+				heartbeatInterval = defaultHeartbeatInterval
 			} else {
-				bot.heartbeatInterval = time.Duration(data.HeartbeatInterval) * time.Millisecond
+				heartbeatInterval = time.Duration(data.HeartbeatInterval) * time.Millisecond
+				bot.session.HelloID = data.SessionID
+				if heartbeatInterval <= 0 {
+					bot.options.Logger.Log(LevelWarn, "hello notification without a heartbeat interval, falling back to 10s")
+					heartbeatInterval = defaultHeartbeatInterval
+				}
 			}
-			go bot.heartbeatLoop(atomic.AddInt32(&bot.heartbeatTaskId, 1))
+			go bot.heartbeatLoop(atomic.AddInt32(&bot.heartbeatTaskId, 1), bot.gateway, heartbeatInterval)
 		case 4: //HEARTBEAT_ACK
-			bot.lastPong = time.Now()
+			bot.stats.ack(time.Now())
 		case 5: //VOICE_STATE_UPDATE
+		case 6: //RESUME
+			// Missed dispatches have been replayed, the state is up to date again.
+			identified()
+		case 9: //INVALID_SESSION
+			bot.session.ID = ""
+			bot.setState(StateIdentifying)
+			err = bot.gatewayIdentity()
+			if err != nil {
+				return err
+			}
 		default:
-			log.Println("unkown notification, op:", n.Op)
+			bot.options.Logger.Log(LevelDebug, "unknown gateway op", "op", n.Op)
 		}
 	}
 }
 func (bot *Bot) User(userID string) (*UserInfo, error) {
-	for _, channel := range bot.state.Channels {
-		for _, recipient := range channel.Recipients {
-			if recipient.ID == userID {
-				return &recipient, nil
-			}
-		}
-		r, ok := bot.Members(channel.ID)[userID]
-		if ok {
-			return &r.User, nil
-		}
+	r, ok := bot.store.user(userID)
+	if ok {
+		return &r, nil
 	}
 	return nil, errors.New("failed to get the user info, please check if it is reachable")
 }
 func (bot *Bot) Channel(channelID string) (*ChannelInfo, error) {
-	sr, ok := bot.state.Channels[channelID]
+	return bot.ChannelCtx(context.Background(), channelID)
+}
+func (bot *Bot) ChannelCtx(ctx context.Context, channelID string) (*ChannelInfo, error) {
+	sr, ok := bot.store.channel(channelID)
+	if ok {
+		return &sr, nil
+	}
+	var r ChannelInfo
+	err := bot.RESTCtx(ctx, "GET", fmt.Sprintf("/channels/%s", channelID), nil, &r)
+	if err != nil {
+		return nil, err
+	}
+	// A guild channel is not cached on its own, which would make ChannelsInGuild return a partial list.
+	if r.IsPrivate() {
+		bot.store.setChannel(r)
+	}
+	return &r, nil
+}
+
+func (bot *Bot) CreateDMChannel(userID string) (*ChannelInfo, error) {
+	return bot.CreateDMChannelCtx(context.Background(), userID)
+}
+
+// CreateDMChannelCtx returns the DM channel with userID, opening it if the bot does not know it yet.
+func (bot *Bot) CreateDMChannelCtx(ctx context.Context, userID string) (*ChannelInfo, error) {
+	sr, ok := bot.store.dmChannel(userID)
 	if ok {
 		return &sr, nil
 	}
 	var r ChannelInfo
-	err := bot.REST("GET", fmt.Sprintf("/channels/%s", channelID), nil, &r)
+	err := bot.RESTCtx(ctx, "POST", "/users/@me/channels", createDMPayload{RecipientID: userID}, &r)
 	if err != nil {
 		return nil, err
 	}
+	bot.store.setChannel(r)
 	return &r, nil
 }
+
+// CachedChannel returns the cached info of a channel, without asking Tomon if it is unknown.
+func (bot *Bot) CachedChannel(channelID string) (*ChannelInfo, bool) {
+	r, ok := bot.store.channel(channelID)
+	if !ok {
+		return nil, false
+	}
+	return &r, true
+}
+
+// Channels returns a copy of every known channel, including DM channels.
 func (bot *Bot) Channels() map[string]ChannelInfo {
-	return bot.state.Channels
+	return bot.store.allChannels()
+}
+
+// Guild returns the cached info of a guild the bot is in.
+func (bot *Bot) Guild(guildID string) (*GuildInfo, bool) {
+	r, ok := bot.store.guild(guildID)
+	if !ok {
+		return nil, false
+	}
+	return &r, true
+}
+
+// Guilds returns a copy of every guild the bot is in.
+func (bot *Bot) Guilds() map[string]GuildInfo {
+	return bot.store.allGuilds()
 }
 func (bot *Bot) ChannelsInGuild(guildID string) (map[string]int, error) {
-	sr, ok := bot.state.ChannelsInGuild[guildID]
+	return bot.ChannelsInGuildCtx(context.Background(), guildID)
+}
+func (bot *Bot) ChannelsInGuildCtx(ctx context.Context, guildID string) (map[string]int, error) {
+	sr, ok := bot.store.channelIDsInGuild(guildID)
 	if ok {
 		return sr, nil
 	}
 	var rr []ChannelInfo
-	err := bot.REST("GET", fmt.Sprintf("/guilds/%s/channels", guildID), nil, &rr)
+	err := bot.RESTCtx(ctx, "GET", fmt.Sprintf("/guilds/%s/channels", guildID), nil, &rr)
 	if err != nil {
 		return nil, err
 	}
@@ -428,26 +619,21 @@ func (bot *Bot) ChannelsInGuild(guildID string) (map[string]int, error) {
 	}
 	return r, nil
 }
+
+// Members returns a copy of the known members of a guild.
 func (bot *Bot) Members(guildID string) map[string]MemberInfo {
-	bot.mux.Lock()
-	defer bot.mux.Unlock()
-	r, ok := bot.state.Members[guildID]
-	if !ok {
-		r = make(map[string]MemberInfo)
-		bot.state.Members[guildID] = r
-	}
-	return r
+	return bot.store.guildMembers(guildID)
 }
 func (bot *Bot) Member(guildID string, userID string) (*MemberInfo, error) {
-	ms, ok := bot.state.Members[guildID]
+	return bot.MemberCtx(context.Background(), guildID, userID)
+}
+func (bot *Bot) MemberCtx(ctx context.Context, guildID string, userID string) (*MemberInfo, error) {
+	sr, ok := bot.store.member(guildID, userID)
 	if ok {
-		r, ok := ms[userID]
-		if ok {
-			return &r, nil
-		}
+		return &sr, nil
 	}
 	var r MemberInfo
-	err := bot.REST("GET", fmt.Sprintf("/guilds/%s/members/%s", guildID, userID), nil, &r)
+	err := bot.RESTCtx(ctx, "GET", fmt.Sprintf("/guilds/%s/members/%s", guildID, userID), nil, &r)
 	if err != nil {
 		return nil, err
 	}
@@ -455,79 +641,140 @@ func (bot *Bot) Member(guildID string, userID string) (*MemberInfo, error) {
 }
 
 func (bot *Bot) RemoveMember(guildID string, userID string) error {
-	err := bot.REST("DELETE", fmt.Sprintf("/guilds/%s/members/%s", guildID, userID), nil, nil)
+	return bot.RemoveMemberCtx(context.Background(), guildID, userID)
+}
+func (bot *Bot) RemoveMemberCtx(ctx context.Context, guildID string, userID string) error {
+	err := bot.RESTCtx(ctx, "DELETE", fmt.Sprintf("/guilds/%s/members/%s", guildID, userID), nil, nil)
 	return err
 }
 
 func (bot *Bot) CreateMessage(channelID string, content string) (*MessageInfo, error) {
-	var payload sendMessagePayload
-	var r MessageInfo
-	payload.Content = content
-	payload.Nonce = fmt.Sprint(time.Now().UnixNano())
-	err := bot.REST("POST", fmt.Sprintf("/channels/%s/messages", channelID), payload, &r)
-	if err != nil {
-		return nil, err
-	}
-	return &r, nil
+	return bot.CreateMessageCtx(context.Background(), channelID, content)
+}
+func (bot *Bot) CreateMessageCtx(ctx context.Context, channelID string, content string) (*MessageInfo, error) {
+	return bot.SendMessageCtx(ctx, channelID, MessageSend{Content: content})
 }
 func (bot *Bot) CreateAttachmentMessage(channelID string, files []ReaderWithName) (*MessageInfo, error) {
+	return bot.CreateAttachmentMessageCtx(context.Background(), channelID, files)
+}
+func (bot *Bot) CreateAttachmentMessageCtx(ctx context.Context, channelID string, files []ReaderWithName) (*MessageInfo, error) {
+	return bot.SendMessageCtx(ctx, channelID, MessageSend{Files: files})
+}
+func (bot *Bot) SendMessage(channelID string, msg MessageSend) (*MessageInfo, error) {
+	return bot.SendMessageCtx(context.Background(), channelID, msg)
+}
+
+// SendMessageCtx creates a message with text content and up to MaxMessageFiles files in channelID.
+func (bot *Bot) SendMessageCtx(ctx context.Context, channelID string, msg MessageSend) (*MessageInfo, error) {
+	if len(msg.Files) > MaxMessageFiles {
+		return nil, fmt.Errorf("a message can have at most %d files, got %d", MaxMessageFiles, len(msg.Files))
+	}
 	var payload sendMessagePayload
 	var r MessageInfo
+	payload.Content = msg.Content
+	payload.Stamps = msg.Stamps
+	payload.ReplyID = msg.ReplyID
 	payload.Nonce = fmt.Sprint(time.Now().UnixNano())
-	payloadBody, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
+	endpoint := fmt.Sprintf("/channels/%s/messages", channelID)
+	if len(msg.Files) == 0 {
+		err := bot.RESTCtx(ctx, "POST", endpoint, payload, &r)
+		if err != nil {
+			return nil, err
+		}
+		return &r, nil
 	}
-	body := new(bytes.Buffer)
-	writer := multipart.NewWriter(body)
-	payloadWriter, err := writer.CreateFormField("payload_json")
+	payloadBody, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
-	_, err = payloadWriter.Write(payloadBody)
+	upload, err := bot.newUpload(payloadBody, msg.Files, msg.Progress)
 	if err != nil {
 		return nil, err
 	}
-	for _, file := range files {
-		fileWriter, err := writer.CreateFormFile("files", file.Name)
-		if err != nil {
-			return nil, err
-		}
-		_, err = io.Copy(fileWriter, file.Reader)
-		if err != nil {
-			return nil, err
-		}
-	}
-	err = writer.Close()
+	body := upload.open()
+	// Stops the writer if the request gave up before reading the whole body.
+	defer upload.close()
+	err = bot.RawRESTCtx(ctx, "POST", endpoint, upload.contentType(), body, &r)
 	if err != nil {
 		return nil, err
 	}
-	err = bot.RawREST("POST", fmt.Sprintf("/channels/%s/messages", channelID), writer.FormDataContentType(), body, &r)
+	return &r, nil
+}
+
+func (bot *Bot) EditMessage(channelID string, messageID string, content string) (*MessageInfo, error) {
+	return bot.EditMessageCtx(context.Background(), channelID, messageID, content)
+}
+
+// EditMessageCtx replaces the content of a message sent by the bot.
+func (bot *Bot) EditMessageCtx(ctx context.Context, channelID string, messageID string, content string) (*MessageInfo, error) {
+	var r MessageInfo
+	err := bot.RESTCtx(ctx, "PATCH", fmt.Sprintf("/channels/%s/messages/%s", channelID, messageID), editMessagePayload{Content: content}, &r)
 	if err != nil {
 		return nil, err
 	}
 	return &r, nil
 }
+func (bot *Bot) DeleteMessage(channelID string, messageID string) error {
+	return bot.DeleteMessageCtx(context.Background(), channelID, messageID)
+}
+func (bot *Bot) DeleteMessageCtx(ctx context.Context, channelID string, messageID string) error {
+	return bot.RESTCtx(ctx, "DELETE", fmt.Sprintf("/channels/%s/messages/%s", channelID, messageID), nil, nil)
+}
+func (bot *Bot) BulkDeleteMessages(channelID string, messageIDs []string) error {
+	return bot.BulkDeleteMessagesCtx(context.Background(), channelID, messageIDs)
+}
 
-func (bot *Bot) heartbeatLoop(taskId int32) {
-	for {
-		if bot.heartbeatTaskId != taskId {
-			break
+// BulkDeleteMessagesCtx deletes messageIDs in requests of up to MaxBulkDelete messages.
+// It stops at the first failed request, so the messages of the following ones are kept.
+func (bot *Bot) BulkDeleteMessagesCtx(ctx context.Context, channelID string, messageIDs []string) error {
+	for len(messageIDs) != 0 {
+		n := len(messageIDs)
+		if n > MaxBulkDelete {
+			n = MaxBulkDelete
+		}
+		var err error
+		if n == 1 {
+			err = bot.DeleteMessageCtx(ctx, channelID, messageIDs[0])
+		} else {
+			err = bot.RESTCtx(ctx, "POST", fmt.Sprintf("/channels/%s/messages/bulk-delete", channelID), bulkDeletePayload{Messages: messageIDs[:n]}, nil)
 		}
-		err := bot.gatewayPing()
 		if err != nil {
-			_ = bot.gateway.Close()
+			return err
+		}
+		messageIDs = messageIDs[n:]
+	}
+	return nil
+}
+
+// heartbeatLoop pings gateway every half interval until another loop is started,
+// and drops the connection if no acknowledgement has arrived for a whole interval.
+func (bot *Bot) heartbeatLoop(taskId int32, gateway *websocket.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	bot.stats.connected(time.Now())
+	for {
+		if atomic.LoadInt32(&bot.heartbeatTaskId) != taskId {
 			break
 		}
-		time.Sleep(bot.heartbeatInterval / 2)
-		if time.Since(bot.lastPong) > bot.heartbeatInterval {
-			log.Println("heartbeat lost, will disconnect")
+		if bot.stats.sinceLastPong(time.Now()) > interval {
+			bot.options.Logger.Log(LevelWarn, "heartbeat lost, will disconnect", "interval", interval)
 			bot.mux.Lock()
-			_ = bot.gateway.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, ""))
+			_ = gateway.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, ""))
 			bot.mux.Unlock()
-			_ = bot.gateway.Close()
+			_ = gateway.Close()
 			break
 		}
+		bot.stats.ping(time.Now())
+		err := bot.gatewayPing(gateway)
+		if err != nil {
+			_ = gateway.Close()
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-bot.done:
+			return
+		}
 	}
 }
 
@@ -540,10 +787,23 @@ func (bot *Bot) gatewayIdentity() error {
 	return bot.gateway.WriteJSON(request)
 }
 
-func (bot *Bot) gatewayPing() error {
+func (bot *Bot) gatewayResume() error {
 	bot.mux.Lock()
 	defer bot.mux.Unlock()
-	return bot.gateway.WriteMessage(websocket.TextMessage, []byte(`{"op":1}`))
+	var request gatewayResumeRequest
+	request.Op = 6
+	request.D.Token = bot.token
+	request.D.SessionID = bot.session.ID
+	request.D.Sequence = bot.session.Sequence
+	return bot.gateway.WriteJSON(request)
+}
+
+// gatewayPing sends a heartbeat on gateway, which may no longer be the current connection:
+// a heartbeat loop must not write to the connection that replaced its own.
+func (bot *Bot) gatewayPing(gateway *websocket.Conn) error {
+	bot.mux.Lock()
+	defer bot.mux.Unlock()
+	return gateway.WriteMessage(websocket.TextMessage, []byte(`{"op":1}`))
 }
 
 func (bot *Bot) gatewayPong() error {
@@ -556,28 +816,27 @@ func (bot *Bot) Self() *UserInfo {
 	return &bot.self
 }
 
+func (bot *Bot) isClosed() bool {
+	bot.mux.Lock()
+	defer bot.mux.Unlock()
+	return bot.closed
+}
+
 func (bot *Bot) Close() error {
 	raiseClose := false
 	bot.mux.Lock()
 	if !bot.closed {
 		bot.closed = true
-		bot.resetState()
+		close(bot.done)
+		bot.store.reset()
 		_ = bot.gateway.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 		_ = bot.gateway.Close()
 		raiseClose = true
 	}
 	bot.mux.Unlock()
+	bot.setState(StateClosed)
 	if raiseClose {
-		if bot.Event.OnClose != nil {
-			bot.Event.OnClose(nil)
-		}
+		bot.emit(&Close{})
 	}
 	return nil
 }
-
-func (bot *Bot) resetState() {
-	bot.state.Guilds = make(map[string]GuildInfo)
-	bot.state.Channels = make(map[string]ChannelInfo)
-	bot.state.Members = make(map[string]map[string]MemberInfo)
-	bot.state.ChannelsInGuild = make(map[string]map[string]int)
-}
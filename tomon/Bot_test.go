@@ -0,0 +1,43 @@
+package tomon_test
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+func TestHelloWithoutHeartbeatIntervalFallsBack(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	server.HeartbeatInterval = 0
+	options := testOptions(server)
+	options.Logger = tomon.NewTextLogger(ioutil.Discard, tomon.LevelOff)
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	states := recordStates(bot)
+
+	received := make(chan string, 1)
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		received <- *e.Content
+	})
+	err := server.DispatchMessageCreate(tomon.MessageInfo{ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dispatch received")
+	}
+	select {
+	case state := <-states:
+		t.Fatalf("connection moved to %v without a heartbeat interval", state)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if bot.State() != tomon.StateReady {
+		t.Errorf("state is %v, want Ready", bot.State())
+	}
+}
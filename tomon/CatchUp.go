@@ -0,0 +1,116 @@
+package tomon
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// catchUpTimeout bounds a catch-up pass, which holds up the gateway goroutine and thus heartbeat acknowledgements.
+// The pass is cut shorter when heartbeats are more frequent, see catchUpDeadline.
+const catchUpTimeout = 10 * time.Second
+
+// catchUpDeadline returns how long a catch-up pass may take without the heartbeat loop
+// taking the acknowledgements it holds up for a lost connection. The loop gives up once
+// no acknowledgement has been read for heartbeatInterval, and the last one can already
+// be up to half an interval old when the pass starts.
+func catchUpDeadline(heartbeatInterval time.Duration) time.Duration {
+	if heartbeatInterval > 0 && heartbeatInterval/4 < catchUpTimeout {
+		return heartbeatInterval / 4
+	}
+	return catchUpTimeout
+}
+
+// catchUp remembers the messages delivered in each channel, so that the ones missed while
+// the bot had to identify again can be fetched and delivered once.
+type catchUp struct {
+	mux sync.Mutex
+	// delivered is the ID of the latest message delivered in each channel.
+	delivered map[string]string
+	// replayed holds the messages delivered by the last catch-up pass, which the gateway may still send.
+	replayed map[string]struct{}
+}
+
+// deliver records msg and reports whether it has not been delivered by a catch-up pass yet.
+func (c *catchUp) deliver(msg *MessageInfo) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.replayed[msg.ID]; ok {
+		delete(c.replayed, msg.ID)
+		return false
+	}
+	if msg.ChannelID != nil {
+		if c.delivered == nil {
+			c.delivered = make(map[string]string)
+		}
+		if last := c.delivered[*msg.ChannelID]; compareIDs(msg.ID, last) > 0 {
+			c.delivered[*msg.ChannelID] = msg.ID
+		}
+	}
+	return true
+}
+
+// baseline returns, for each channel known before identifying again, the ID after which messages were missed.
+func (c *catchUp) baseline(channels map[string]ChannelInfo) map[string]string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	r := make(map[string]string, len(channels))
+	for id, channel := range channels {
+		if channel.LastMessageID != "" {
+			r[id] = channel.LastMessageID
+		}
+	}
+	for id, last := range c.delivered {
+		if compareIDs(last, r[id]) > 0 {
+			r[id] = last
+		}
+	}
+	return r
+}
+
+func (c *catchUp) replay(msgs []MessageInfo) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.replayed = make(map[string]struct{}, len(msgs))
+	for _, msg := range msgs {
+		c.replayed[msg.ID] = struct{}{}
+	}
+}
+
+// catchUpMessages delivers the messages posted since baseline in the channels the bot still knows,
+// oldest first, at most Options.CatchUpMessages per channel.
+func (bot *Bot) catchUpMessages(baseline map[string]string, heartbeatInterval time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), catchUpDeadline(heartbeatInterval))
+	defer cancel()
+	var missed []MessageInfo
+	for channelID, last := range baseline {
+		channel, ok := bot.store.channel(channelID)
+		if !ok || compareIDs(channel.LastMessageID, last) <= 0 {
+			continue
+		}
+		it := bot.MessageHistory(channelID, MessageQuery{After: last, Limit: bot.options.CatchUpMessages})
+		for it.Next(ctx) {
+			msg := *it.Message()
+			if msg.ChannelID == nil {
+				msg.ChannelID = &channelID
+			}
+			missed = append(missed, msg)
+		}
+		if err := it.Err(); err != nil {
+			bot.options.Logger.Log(LevelWarn, "failed to catch up on missed messages", "channel", channelID, "err", err)
+		}
+	}
+	if len(missed) == 0 {
+		return
+	}
+	sort.Slice(missed, func(i, j int) bool {
+		return compareIDs(missed[i].ID, missed[j].ID) < 0
+	})
+	bot.options.Logger.Log(LevelInfo, "catching up on missed messages", "count", len(missed))
+	for i := range missed {
+		bot.catchUp.deliver(&missed[i])
+		bot.emit(&MessageCreate{MessageInfo: missed[i]})
+	}
+	bot.catchUp.replay(missed)
+}
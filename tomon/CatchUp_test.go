@@ -0,0 +1,108 @@
+package tomon_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+func newCatchUpServer() *tomontest.Server {
+	server := tomontest.NewServer()
+	server.Identity.Guilds = []tomontest.IdentityGuild{{
+		GuildInfo: tomon.GuildInfo{ID: "10"},
+		Channels:  []tomon.ChannelInfo{{ID: "20", GuildID: "10"}},
+	}}
+	return server
+}
+
+func TestCatchUpDeliversMissedMessagesOnce(t *testing.T) {
+	server := newCatchUpServer()
+	defer server.Close()
+	options := testOptions(server)
+	options.CatchUpMessages = 10
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	received := make(chan string, 16)
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		received <- e.ID
+	})
+	err := server.DispatchMessageCreate(tomon.MessageInfo{ID: "100", ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := <-received; id != "100" {
+		t.Fatalf("received %s, want 100", id)
+	}
+
+	server.InvalidateSessions()
+	server.DropConnections()
+	for _, id := range []string{"101", "102", "103"} {
+		server.AddMessages(tomon.MessageInfo{ID: id, ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("")})
+	}
+	if err := server.WaitReady(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"101", "102", "103"} {
+		select {
+		case id := <-received:
+			if id != want {
+				t.Fatalf("received %s, want %s", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missed message %s was not delivered", want)
+		}
+	}
+	// The gateway may still send a message the catch-up pass already delivered.
+	err = server.Dispatch("MESSAGE_CREATE", tomon.MessageInfo{ID: "103", ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.DispatchMessageCreate(tomon.MessageInfo{ID: "104", ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := <-received; id != "104" {
+		t.Fatalf("received %s, want 104 only once 103 was skipped", id)
+	}
+}
+
+// TestSlowCatchUpKeepsTheConnection makes the history endpoint hang for longer than the
+// heartbeat interval: the pass has to give up before the heartbeat loop drops the connection.
+func TestSlowCatchUpKeepsTheConnection(t *testing.T) {
+	server := newCatchUpServer()
+	defer server.Close()
+	server.HeartbeatInterval = 400 * time.Millisecond
+	options := testOptions(server)
+	options.CatchUpMessages = 10
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	states := recordStates(bot)
+	err := server.DispatchMessageCreate(tomon.MessageInfo{ID: "100", ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.HandleFunc("GET", "/channels/{channel}/messages", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	server.InvalidateSessions()
+	server.DropConnections()
+	server.AddMessages(tomon.MessageInfo{ID: "101", ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("")})
+	waitStates(t, states, tomon.StateIdentifying, tomon.StateReady)
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			t.Fatalf("connection moved to %v after catching up", state)
+		case <-timeout:
+			return
+		}
+	}
+}
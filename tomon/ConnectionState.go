@@ -0,0 +1,69 @@
+package tomon
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// ConnectionState is the state of the gateway connection of a Bot.
+type ConnectionState int32
+
+const (
+	// StateDisconnected means there is no connection, and the Bot is waiting to connect again.
+	StateDisconnected ConnectionState = iota
+	// StateConnecting means the websocket connection is being established.
+	StateConnecting
+	// StateIdentifying means the Bot has sent IDENTITY and waits for the initial state.
+	StateIdentifying
+	// StateResuming means the Bot has asked to resume its previous session.
+	StateResuming
+	// StateReady means events are being received.
+	StateReady
+	// StateClosed means the Bot was closed or gave up reconnecting. It is final.
+	StateClosed
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case StateDisconnected:
+		return "Disconnected"
+	case StateConnecting:
+		return "Connecting"
+	case StateIdentifying:
+		return "Identifying"
+	case StateResuming:
+		return "Resuming"
+	case StateReady:
+		return "Ready"
+	case StateClosed:
+		return "Closed"
+	}
+	return "ConnectionState(" + strconv.Itoa(int(state)) + ")"
+}
+
+// StateChange is emitted whenever the gateway connection moves to another state.
+type StateChange struct {
+	Old ConnectionState
+	New ConnectionState
+}
+
+func (*StateChange) EventName() string { return "STATE_CHANGE" }
+
+// State returns the current state of the gateway connection.
+func (bot *Bot) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&bot.connectionState))
+}
+
+// setState moves to state and emits StateChange. Nothing leaves StateClosed.
+func (bot *Bot) setState(state ConnectionState) {
+	for {
+		old := atomic.LoadInt32(&bot.connectionState)
+		if ConnectionState(old) == state || ConnectionState(old) == StateClosed {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&bot.connectionState, old, int32(state)) {
+			bot.emit(&StateChange{Old: ConnectionState(old), New: state})
+			return
+		}
+	}
+}
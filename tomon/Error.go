@@ -0,0 +1,90 @@
+package tomon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const maxErrorBodySize = 64 * 1024
+
+// APIError is returned when the Tomon REST API answers with an error status.
+type APIError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Code is the Tomon error code from the response body, or 0 if there is none.
+	Code int
+	// Message is the error message from the response body, or the HTTP status text if there is none.
+	Message  string
+	Method   string
+	Endpoint string
+	// Body is the raw response body, truncated to 64 KiB.
+	Body []byte
+}
+
+func (e *APIError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("failed to send REST request: %s %s: %d %s (code %d)", e.Method, e.Endpoint, e.StatusCode, e.Message, e.Code)
+	}
+	return fmt.Sprintf("failed to send REST request: %s %s: %d %s", e.Method, e.Endpoint, e.StatusCode, e.Message)
+}
+
+func readErrorBody(body io.Reader) []byte {
+	r, _ := ioutil.ReadAll(io.LimitReader(body, maxErrorBodySize))
+	return r
+}
+
+func newAPIError(method string, endpoint string, resp *http.Response, body []byte) *APIError {
+	r := &APIError{
+		StatusCode: resp.StatusCode,
+		Method:     method,
+		Endpoint:   endpoint,
+		Body:       body,
+	}
+	var payload struct {
+		Code    interface{} `json:"code"`
+		Message string      `json:"message"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		switch code := payload.Code.(type) {
+		case float64:
+			r.Code = int(code)
+		case string:
+			r.Code, _ = strconv.Atoi(code)
+		}
+		r.Message = payload.Message
+	}
+	if r.Message == "" {
+		r.Message = http.StatusText(resp.StatusCode)
+	}
+	return r
+}
+
+func hasStatus(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// IsNotFound reports whether err is an APIError for a missing resource, such as an unknown channel.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsForbidden reports whether err is an APIError caused by missing permissions.
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// IsUnauthorized reports whether err is an APIError caused by an invalid token or credentials.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// IsRateLimited reports whether err is an APIError for a request that was still rate limited after all retries.
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
@@ -0,0 +1,80 @@
+package tomon_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+func TestAPIErrorParsesTheResponse(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	options := testOptions(server)
+	options.MaxRateLimitRetries = -1
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+
+	large := bytes.Repeat([]byte("x"), 100<<10)
+	tests := []struct {
+		name    string
+		status  int
+		body    []byte
+		code    int
+		message string
+		// is names the predicate that should report the error, if any.
+		is string
+	}{
+		{"numeric", http.StatusForbidden, []byte(`{"code":50013,"message":"Missing Permissions"}`), 50013, "Missing Permissions", "IsForbidden"},
+		{"string", http.StatusUnauthorized, []byte(`{"code":"40001","message":"Invalid Token"}`), 40001, "Invalid Token", "IsUnauthorized"},
+		{"empty", http.StatusNotFound, nil, 0, "Not Found", "IsNotFound"},
+		{"limited", http.StatusTooManyRequests, []byte(`{"message":"You are being rate limited.","retry_after":0.01}`), 0, "You are being rate limited.", "IsRateLimited"},
+		{"html", http.StatusBadGateway, []byte("<html>Bad Gateway</html>"), 0, "Bad Gateway", ""},
+		{"large", http.StatusInternalServerError, large, 0, "Internal Server Error", ""},
+	}
+	server.HandleFunc("GET", "/channels/{channel}", func(w http.ResponseWriter, r *http.Request) {
+		for _, test := range tests {
+			if test.name == tomontest.Var(r, "channel") {
+				w.WriteHeader(test.status)
+				_, _ = w.Write(test.body)
+				return
+			}
+		}
+	})
+
+	predicates := map[string]func(error) bool{
+		"IsNotFound":     tomon.IsNotFound,
+		"IsForbidden":    tomon.IsForbidden,
+		"IsUnauthorized": tomon.IsUnauthorized,
+		"IsRateLimited":  tomon.IsRateLimited,
+	}
+	for _, test := range tests {
+		_, err := bot.Channel(test.name)
+		var apiErr *tomon.APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%s: got %v, want an *APIError", test.name, err)
+			continue
+		}
+		if apiErr.StatusCode != test.status || apiErr.Code != test.code || apiErr.Message != test.message {
+			t.Errorf("%s: got status %d, code %d, message %q, want %d, %d, %q", test.name, apiErr.StatusCode, apiErr.Code, apiErr.Message, test.status, test.code, test.message)
+		}
+		if apiErr.Method != "GET" || apiErr.Endpoint != "/channels/"+test.name {
+			t.Errorf("%s: error is for %s %s", test.name, apiErr.Method, apiErr.Endpoint)
+		}
+		want := test.body
+		if len(want) > 64<<10 {
+			want = want[:64<<10]
+		}
+		if !bytes.Equal(apiErr.Body, want) {
+			t.Errorf("%s: kept a body of %d bytes, want %d", test.name, len(apiErr.Body), len(want))
+		}
+		for name, is := range predicates {
+			if got := is(err); got != (name == test.is) {
+				t.Errorf("%s: %s reported %v", test.name, name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package tomon
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultStreamBuffer = 64
+
+// OverflowPolicy decides what an EventStream does with an event when its buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest buffered event to make room for the new one.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the new event.
+	OverflowDropNewest
+	// OverflowBlock waits for the consumer. This stalls the gateway goroutine, so heartbeat
+	// acknowledgements are not read either and a slow consumer may cause a reconnect.
+	OverflowBlock
+)
+
+// EventFilter reports whether an event should be delivered. A nil EventFilter accepts every event.
+type EventFilter func(Event) bool
+
+// EventNames returns an EventFilter accepting the events whose EventName is one of names.
+// Streams never receive RawOp and RawDispatch, so "RAW_OP" and "RAW_DISPATCH" match nothing.
+func EventNames(names ...string) EventFilter {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return func(e Event) bool {
+		_, ok := set[e.EventName()]
+		return ok
+	}
+}
+
+// StreamOptions configures an EventStream.
+type StreamOptions struct {
+	Filter EventFilter
+	// Buffer is the capacity of the channel. Defaults to 64.
+	Buffer int
+	// Overflow is applied when the buffer is full. Defaults to OverflowDropOldest.
+	Overflow OverflowPolicy
+}
+
+// EventStream delivers the events of a Bot on a channel.
+//
+// Like a func(Event) handler, it receives every event except RawOp and RawDispatch, which
+// duplicate the typed events. Add a func(*RawOp) or func(*RawDispatch) handler to get those.
+//
+// C is closed once the context passed to Bot.EventStream is done or the Bot emits Close,
+// which is the last event delivered.
+type EventStream struct {
+	dropped uint64 // first for 64-bit alignment of atomic operations
+	C       <-chan Event
+	c       chan Event
+	options StreamOptions
+	mux     sync.Mutex
+	closed  bool
+	done    chan struct{}
+	remove  func()
+}
+
+// Events is a shortcut for EventStream(ctx, StreamOptions{Filter: filter}).C.
+func (bot *Bot) Events(ctx context.Context, filter EventFilter) <-chan Event {
+	return bot.EventStream(ctx, StreamOptions{Filter: filter}).C
+}
+
+// EventStream subscribes to the events of bot until ctx is done.
+func (bot *Bot) EventStream(ctx context.Context, options StreamOptions) *EventStream {
+	if options.Buffer <= 0 {
+		options.Buffer = defaultStreamBuffer
+	}
+	c := make(chan Event, options.Buffer)
+	stream := &EventStream{C: c, c: c, options: options, done: make(chan struct{})}
+	stream.remove = bot.events.add(anyEvent, func(e Event) {
+		stream.deliver(ctx, e)
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.close()
+		case <-stream.done:
+		}
+	}()
+	return stream
+}
+
+// Dropped returns how many events were discarded because the buffer was full.
+func (stream *EventStream) Dropped() uint64 {
+	return atomic.LoadUint64(&stream.dropped)
+}
+
+func (stream *EventStream) deliver(ctx context.Context, e Event) {
+	if stream.options.Filter != nil && !stream.options.Filter(e) {
+		if _, ok := e.(*Close); ok {
+			stream.close()
+		}
+		return
+	}
+	stream.mux.Lock()
+	if stream.closed {
+		stream.mux.Unlock()
+		return
+	}
+	switch stream.options.Overflow {
+	case OverflowBlock:
+		select {
+		case stream.c <- e:
+		case <-ctx.Done():
+		}
+	case OverflowDropNewest:
+		select {
+		case stream.c <- e:
+		default:
+			atomic.AddUint64(&stream.dropped, 1)
+		}
+	default:
+		for sent := false; !sent; {
+			select {
+			case stream.c <- e:
+				sent = true
+			default:
+				select {
+				case <-stream.c:
+					atomic.AddUint64(&stream.dropped, 1)
+				default:
+				}
+			}
+		}
+	}
+	stream.mux.Unlock()
+	if _, ok := e.(*Close); ok {
+		stream.close()
+	}
+}
+
+func (stream *EventStream) close() {
+	stream.mux.Lock()
+	defer stream.mux.Unlock()
+	if stream.closed {
+		return
+	}
+	stream.closed = true
+	stream.remove()
+	close(stream.c)
+	close(stream.done)
+}
@@ -0,0 +1,211 @@
+package tomon_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+// dispatchMessages dispatches messages with the contents "1" to strconv.Itoa(n) and waits until the
+// handlers added so far, streams included, have been given all of them.
+func dispatchMessages(t *testing.T, server *tomontest.Server, bot *tomon.Bot, n int) {
+	t.Helper()
+	last := make(chan struct{})
+	// A func(Event) handler runs after the streams subscribed before it.
+	remove := bot.AddHandler(func(e tomon.Event) {
+		if msg, ok := e.(*tomon.MessageCreate); ok && *msg.Content == strconv.Itoa(n) {
+			close(last)
+		}
+	})
+	defer remove()
+	for i := 1; i <= n; i++ {
+		err := server.DispatchMessageCreate(tomon.MessageInfo{ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr(strconv.Itoa(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-last:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message %d was not dispatched", n)
+	}
+}
+
+// receiveContents reads n events from c and returns their message contents.
+func receiveContents(t *testing.T, c <-chan tomon.Event, n int) []string {
+	t.Helper()
+	var contents []string
+	for len(contents) < n {
+		select {
+		case e, ok := <-c:
+			if !ok {
+				t.Fatalf("stream closed after %v", contents)
+			}
+			msg, isMessage := e.(*tomon.MessageCreate)
+			if !isMessage {
+				t.Fatalf("stream delivered %s, want MESSAGE_CREATE", e.EventName())
+			}
+			contents = append(contents, *msg.Content)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after receiving %v", contents)
+		}
+	}
+	return contents
+}
+
+// waitClosed fails t unless c is closed, and returns the events that were still buffered.
+func waitClosed(t *testing.T, c <-chan tomon.Event) []tomon.Event {
+	t.Helper()
+	var rest []tomon.Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-c:
+			if !ok {
+				return rest
+			}
+			rest = append(rest, e)
+		case <-timeout:
+			t.Fatal("stream was not closed")
+		}
+	}
+}
+
+func equalStrings(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEventStreamOverflow(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+
+	tests := []struct {
+		overflow tomon.OverflowPolicy
+		want     []string
+		dropped  uint64
+	}{
+		{tomon.OverflowDropOldest, []string{"4", "5"}, 3},
+		{tomon.OverflowDropNewest, []string{"1", "2"}, 3},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := bot.EventStream(ctx, tomon.StreamOptions{Filter: tomon.EventNames("MESSAGE_CREATE"), Buffer: 2, Overflow: test.overflow})
+		dispatchMessages(t, server, bot, 5)
+		if got := receiveContents(t, stream.C, 2); !equalStrings(got, test.want...) {
+			t.Errorf("policy %d kept %v, want %v", test.overflow, got, test.want)
+		}
+		if dropped := stream.Dropped(); dropped != test.dropped {
+			t.Errorf("policy %d dropped %d events, want %d", test.overflow, dropped, test.dropped)
+		}
+		cancel()
+		if rest := waitClosed(t, stream.C); len(rest) != 0 {
+			t.Errorf("policy %d buffered %d more events than it could hold", test.overflow, len(rest))
+		}
+	}
+}
+
+func TestEventStreamBlockWaitsForTheConsumer(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := bot.EventStream(ctx, tomon.StreamOptions{Filter: tomon.EventNames("MESSAGE_CREATE"), Buffer: 2, Overflow: tomon.OverflowBlock})
+
+	dispatched := make(chan struct{})
+	bot.AddHandler(func(e tomon.Event) {
+		if msg, ok := e.(*tomon.MessageCreate); ok && *msg.Content == "5" {
+			close(dispatched)
+		}
+	})
+	for i := 1; i <= 5; i++ {
+		err := server.DispatchMessageCreate(tomon.MessageInfo{ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr(strconv.Itoa(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-dispatched:
+		t.Fatal("all messages were dispatched although the stream could hold 2")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := receiveContents(t, stream.C, 5); !equalStrings(got, "1", "2", "3", "4", "5") {
+		t.Errorf("received %v, want every message in order", got)
+	}
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the gateway stayed blocked after the stream was drained")
+	}
+	if dropped := stream.Dropped(); dropped != 0 {
+		t.Errorf("dropped %d events", dropped)
+	}
+}
+
+func TestEventStreamFilter(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := bot.Events(ctx, tomon.EventNames("MESSAGE_CREATE"))
+
+	if err := server.Dispatch("CHANNEL_CREATE", tomon.ChannelInfo{ID: "21", Type: tomon.ChannelTypeDM}); err != nil {
+		t.Fatal(err)
+	}
+	dispatchMessages(t, server, bot, 1)
+	if got := receiveContents(t, c, 1); !equalStrings(got, "1") {
+		t.Errorf("received %v, want the message only", got)
+	}
+}
+
+func TestEventStreamClosesWhenTheContextIsDone(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := bot.EventStream(ctx, tomon.StreamOptions{})
+
+	cancel()
+	waitClosed(t, stream.C)
+	// Delivering to the closed stream must neither panic nor block.
+	dispatchMessages(t, server, bot, 1)
+}
+
+func TestEventStreamClosesWithTheBot(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	stream := bot.EventStream(context.Background(), tomon.StreamOptions{})
+	filtered := bot.EventStream(context.Background(), tomon.StreamOptions{Filter: tomon.EventNames("MESSAGE_CREATE")})
+
+	bot.Close()
+	rest := waitClosed(t, stream.C)
+	if len(rest) == 0 {
+		t.Fatal("stream closed without delivering Close")
+	}
+	if _, ok := rest[len(rest)-1].(*tomon.Close); !ok {
+		t.Errorf("last event is %s, want Close", rest[len(rest)-1].EventName())
+	}
+	// Close is filtered out, the stream still ends with the bot.
+	if rest := waitClosed(t, filtered.C); len(rest) != 0 {
+		t.Errorf("filtered stream delivered %d events", len(rest))
+	}
+}
@@ -0,0 +1,280 @@
+package tomon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Event is implemented by every event a Bot emits. EventName returns the gateway name
+// of the event, such as MESSAGE_CREATE, or CLOSE for the end of the connection.
+type Event interface {
+	EventName() string
+}
+
+// RawOp is emitted for every frame received from the gateway, before it is handled.
+type RawOp struct {
+	Op   int
+	Data json.RawMessage
+}
+
+// RawDispatch is emitted for every DISPATCH frame, including the ones this package does not know,
+// before it is handled.
+type RawDispatch struct {
+	Name string
+	Data json.RawMessage
+}
+
+type Close struct {
+	// Err is nil if the connection was closed by user.
+	Err error
+}
+type GuildCreate struct{ GuildInfo }
+type GuildUpdate struct{ GuildInfo }
+type GuildDelete struct{ GuildInfo }
+type ChannelCreate struct{ ChannelInfo }
+type ChannelUpdate struct{ ChannelInfo }
+type ChannelDelete struct{ ChannelInfo }
+type GuildMemberAdd struct{ MemberInfo }
+type GuildMemberUpdate struct{ MemberInfo }
+type GuildMemberRemove struct{ MemberInfo }
+type MessageCreate struct{ MessageInfo }
+type MessageUpdate struct{ MessageInfo }
+type MessageDelete struct{ MessageInfo }
+type MessageReactionAdd struct{ MessageReactionInfo }
+type MessageReactionRemove struct{ MessageReactionInfo }
+
+func (*RawOp) EventName() string                 { return "RAW_OP" }
+func (*RawDispatch) EventName() string           { return "RAW_DISPATCH" }
+func (*Close) EventName() string                 { return "CLOSE" }
+func (*GuildCreate) EventName() string           { return "GUILD_CREATE" }
+func (*GuildUpdate) EventName() string           { return "GUILD_UPDATE" }
+func (*GuildDelete) EventName() string           { return "GUILD_DELETE" }
+func (*ChannelCreate) EventName() string         { return "CHANNEL_CREATE" }
+func (*ChannelUpdate) EventName() string         { return "CHANNEL_UPDATE" }
+func (*ChannelDelete) EventName() string         { return "CHANNEL_DELETE" }
+func (*GuildMemberAdd) EventName() string        { return "GUILD_MEMBER_ADD" }
+func (*GuildMemberUpdate) EventName() string     { return "GUILD_MEMBER_UPDATE" }
+func (*GuildMemberRemove) EventName() string     { return "GUILD_MEMBER_REMOVE" }
+func (*MessageCreate) EventName() string         { return "MESSAGE_CREATE" }
+func (*MessageUpdate) EventName() string         { return "MESSAGE_UPDATE" }
+func (*MessageDelete) EventName() string         { return "MESSAGE_DELETE" }
+func (*MessageReactionAdd) EventName() string    { return "MESSAGE_REACTION_ADD" }
+func (*MessageReactionRemove) EventName() string { return "MESSAGE_REACTION_REMOVE" }
+
+// anyEvent is the key of handlers receiving every event.
+const anyEvent = ""
+
+type eventHandler struct {
+	fn func(Event)
+}
+
+type eventBus struct {
+	mux      sync.RWMutex
+	handlers map[string][]*eventHandler
+	logger   Logger
+}
+
+// AddHandler registers handler for the event matching its parameter type, e.g. func(*MessageCreate),
+// or for every event except RawOp and RawDispatch if it is a func(Event). Handlers of an event run one by one on the gateway
+// goroutine in the order they were added, after the matching Bot.Event callback. A panicking
+// handler is logged and does not affect the others.
+// The returned function removes the handler.
+func (bot *Bot) AddHandler(handler interface{}) func() {
+	name, fn := wrapHandler(handler)
+	return bot.events.add(name, fn)
+}
+
+func wrapHandler(handler interface{}) (string, func(Event)) {
+	switch h := handler.(type) {
+	case func(Event):
+		return anyEvent, h
+	case func(*RawOp):
+		return (*RawOp)(nil).EventName(), func(e Event) { h(e.(*RawOp)) }
+	case func(*RawDispatch):
+		return (*RawDispatch)(nil).EventName(), func(e Event) { h(e.(*RawDispatch)) }
+	case func(*Close):
+		return (*Close)(nil).EventName(), func(e Event) { h(e.(*Close)) }
+	case func(*Reconnecting):
+		return (*Reconnecting)(nil).EventName(), func(e Event) { h(e.(*Reconnecting)) }
+	case func(*Reconnected):
+		return (*Reconnected)(nil).EventName(), func(e Event) { h(e.(*Reconnected)) }
+	case func(*StateChange):
+		return (*StateChange)(nil).EventName(), func(e Event) { h(e.(*StateChange)) }
+	case func(*GuildCreate):
+		return (*GuildCreate)(nil).EventName(), func(e Event) { h(e.(*GuildCreate)) }
+	case func(*GuildUpdate):
+		return (*GuildUpdate)(nil).EventName(), func(e Event) { h(e.(*GuildUpdate)) }
+	case func(*GuildDelete):
+		return (*GuildDelete)(nil).EventName(), func(e Event) { h(e.(*GuildDelete)) }
+	case func(*ChannelCreate):
+		return (*ChannelCreate)(nil).EventName(), func(e Event) { h(e.(*ChannelCreate)) }
+	case func(*ChannelUpdate):
+		return (*ChannelUpdate)(nil).EventName(), func(e Event) { h(e.(*ChannelUpdate)) }
+	case func(*ChannelDelete):
+		return (*ChannelDelete)(nil).EventName(), func(e Event) { h(e.(*ChannelDelete)) }
+	case func(*GuildMemberAdd):
+		return (*GuildMemberAdd)(nil).EventName(), func(e Event) { h(e.(*GuildMemberAdd)) }
+	case func(*GuildMemberUpdate):
+		return (*GuildMemberUpdate)(nil).EventName(), func(e Event) { h(e.(*GuildMemberUpdate)) }
+	case func(*GuildMemberRemove):
+		return (*GuildMemberRemove)(nil).EventName(), func(e Event) { h(e.(*GuildMemberRemove)) }
+	case func(*MessageCreate):
+		return (*MessageCreate)(nil).EventName(), func(e Event) { h(e.(*MessageCreate)) }
+	case func(*MessageUpdate):
+		return (*MessageUpdate)(nil).EventName(), func(e Event) { h(e.(*MessageUpdate)) }
+	case func(*MessageDelete):
+		return (*MessageDelete)(nil).EventName(), func(e Event) { h(e.(*MessageDelete)) }
+	case func(*MessageReactionAdd):
+		return (*MessageReactionAdd)(nil).EventName(), func(e Event) { h(e.(*MessageReactionAdd)) }
+	case func(*MessageReactionRemove):
+		return (*MessageReactionRemove)(nil).EventName(), func(e Event) { h(e.(*MessageReactionRemove)) }
+	}
+	panic(fmt.Sprintf("tomon: unsupported event handler type %T", handler))
+}
+
+func (bus *eventBus) add(name string, fn func(Event)) func() {
+	h := &eventHandler{fn: fn}
+	bus.mux.Lock()
+	if bus.handlers == nil {
+		bus.handlers = make(map[string][]*eventHandler)
+	}
+	bus.handlers[name] = append(bus.handlers[name], h)
+	bus.mux.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			bus.mux.Lock()
+			defer bus.mux.Unlock()
+			list := bus.handlers[name]
+			for i, candidate := range list {
+				if candidate == h {
+					// Copy so that a concurrent emit keeps iterating over the old list.
+					bus.handlers[name] = append(append([]*eventHandler(nil), list[:i]...), list[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+func (bus *eventBus) emit(event Event) {
+	bus.mux.RLock()
+	specific := bus.handlers[event.EventName()]
+	var all []*eventHandler
+	switch event.(type) {
+	case *RawOp, *RawDispatch:
+		// Raw events duplicate the typed ones, only explicit subscribers get them.
+	default:
+		all = bus.handlers[anyEvent]
+	}
+	bus.mux.RUnlock()
+	for _, h := range specific {
+		h.call(bus.logger, event)
+	}
+	for _, h := range all {
+		h.call(bus.logger, event)
+	}
+}
+
+func (h *eventHandler) call(logger Logger, event Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Log(LevelError, "panic in event handler", "event", event.EventName(), "panic", fmt.Sprint(err))
+		}
+	}()
+	h.fn(event)
+}
+
+// emit runs the Bot.Event callback matching event, then every handler added with AddHandler.
+// A panicking callback is logged like a panicking handler.
+func (bot *Bot) emit(event Event) {
+	(&eventHandler{fn: bot.runCallback}).call(bot.options.Logger, event)
+	bot.events.emit(event)
+}
+
+// runCallback runs the Bot.Event callback matching event.
+func (bot *Bot) runCallback(event Event) {
+	switch e := event.(type) {
+	case *RawOp:
+		if bot.Event.OnRawOp != nil {
+			bot.Event.OnRawOp(e.Op, e.Data)
+		}
+	case *RawDispatch:
+		if bot.Event.OnRawDispatch != nil {
+			bot.Event.OnRawDispatch(e.Name, e.Data)
+		}
+	case *Close:
+		if bot.Event.OnClose != nil {
+			bot.Event.OnClose(e.Err)
+		}
+	case *Reconnecting:
+		if bot.Event.OnReconnecting != nil {
+			bot.Event.OnReconnecting(e.Attempt, e.Delay)
+		}
+	case *Reconnected:
+		if bot.Event.OnReconnected != nil {
+			bot.Event.OnReconnected()
+		}
+	case *StateChange:
+		if bot.Event.OnStateChange != nil {
+			bot.Event.OnStateChange(e.Old, e.New)
+		}
+	case *GuildCreate:
+		if bot.Event.OnGuildCreate != nil {
+			bot.Event.OnGuildCreate(&e.GuildInfo)
+		}
+	case *GuildUpdate:
+		if bot.Event.OnGuildUpdate != nil {
+			bot.Event.OnGuildUpdate(&e.GuildInfo)
+		}
+	case *GuildDelete:
+		if bot.Event.OnGuildDelete != nil {
+			bot.Event.OnGuildDelete(&e.GuildInfo)
+		}
+	case *ChannelCreate:
+		if bot.Event.OnChannelCreate != nil {
+			bot.Event.OnChannelCreate(&e.ChannelInfo)
+		}
+	case *ChannelUpdate:
+		if bot.Event.OnChannelUpdate != nil {
+			bot.Event.OnChannelUpdate(&e.ChannelInfo)
+		}
+	case *ChannelDelete:
+		if bot.Event.OnChannelDelete != nil {
+			bot.Event.OnChannelDelete(&e.ChannelInfo)
+		}
+	case *GuildMemberAdd:
+		if bot.Event.OnGuildMemberAdd != nil {
+			bot.Event.OnGuildMemberAdd(&e.MemberInfo)
+		}
+	case *GuildMemberUpdate:
+		if bot.Event.OnGuildMemberUpdate != nil {
+			bot.Event.OnGuildMemberUpdate(&e.MemberInfo)
+		}
+	case *GuildMemberRemove:
+		if bot.Event.OnGuildMemberRemove != nil {
+			bot.Event.OnGuildMemberRemove(&e.MemberInfo)
+		}
+	case *MessageCreate:
+		if bot.Event.OnMessageCreate != nil {
+			bot.Event.OnMessageCreate(&e.MessageInfo)
+		}
+	case *MessageUpdate:
+		if bot.Event.OnMessageUpdate != nil {
+			bot.Event.OnMessageUpdate(&e.MessageInfo)
+		}
+	case *MessageDelete:
+		if bot.Event.OnMessageDelete != nil {
+			bot.Event.OnMessageDelete(&e.MessageInfo)
+		}
+	case *MessageReactionAdd:
+		if bot.Event.OnMessageReactionAdd != nil {
+			bot.Event.OnMessageReactionAdd(&e.MessageReactionInfo)
+		}
+	case *MessageReactionRemove:
+		if bot.Event.OnMessageReactionRemove != nil {
+			bot.Event.OnMessageReactionRemove(&e.MessageReactionInfo)
+		}
+	}
+}
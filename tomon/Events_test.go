@@ -0,0 +1,93 @@
+package tomon_test
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+func TestPanickingCallbackKeepsTheConnection(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	options := testOptions(server)
+	options.Logger = tomon.NewTextLogger(ioutil.Discard, tomon.LevelOff)
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	states := recordStates(bot)
+	bot.Event.OnMessageCreate = func(*tomon.MessageInfo) {
+		panic("callback failed")
+	}
+	received := make(chan string, 2)
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		received <- *e.Content
+	})
+
+	for _, content := range []string{"first", "second"} {
+		err := server.DispatchMessageCreate(tomon.MessageInfo{ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr(content)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-received:
+			if got != content {
+				t.Fatalf("handler received %q, want %q", got, content)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler did not receive %q after the callback panicked", content)
+		}
+	}
+	select {
+	case state := <-states:
+		t.Fatalf("connection moved to %v after a callback panicked", state)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandlersRunInOrderUntilRemoved(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	calls := make(chan string, 16)
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		calls <- "first " + *e.Content
+	})
+	remove := bot.AddHandler(func(e *tomon.MessageCreate) {
+		calls <- "second " + *e.Content
+	})
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		calls <- "third " + *e.Content
+	})
+
+	expect := func(want ...string) {
+		t.Helper()
+		for _, call := range want {
+			select {
+			case got := <-calls:
+				if got != call {
+					t.Fatalf("got call %q, want %q", got, call)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for call %q", call)
+			}
+		}
+	}
+	dispatch := func(content string) {
+		t.Helper()
+		err := server.DispatchMessageCreate(tomon.MessageInfo{ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr(content)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dispatch("a")
+	expect("first a", "second a", "third a")
+	remove()
+	// Removing twice must not remove another handler.
+	remove()
+	dispatch("b")
+	expect("first b", "third b")
+}
@@ -0,0 +1,184 @@
+package tomon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// MaxMessagesLimit is the maximum number of messages returned by one history request.
+const MaxMessagesLimit = 100
+
+// MessageQuery selects a page of the history of a channel. At most one of Before, After and Around
+// should be set; without any of them the latest messages are returned.
+type MessageQuery struct {
+	// Before selects messages older than this message ID.
+	Before string
+	// After selects messages newer than this message ID.
+	After string
+	// Around selects messages around this message ID.
+	Around string
+	// Limit is the number of messages to return, up to MaxMessagesLimit. 0 lets Tomon decide.
+	Limit int
+}
+
+func (query *MessageQuery) values() url.Values {
+	values := url.Values{}
+	if query.Before != "" {
+		values.Set("before", query.Before)
+	}
+	if query.After != "" {
+		values.Set("after", query.After)
+	}
+	if query.Around != "" {
+		values.Set("around", query.Around)
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+	return values
+}
+
+func (bot *Bot) Messages(channelID string, query MessageQuery) ([]MessageInfo, error) {
+	return bot.MessagesCtx(context.Background(), channelID, query)
+}
+
+// MessagesCtx returns one page of the history of channelID, newest first.
+func (bot *Bot) MessagesCtx(ctx context.Context, channelID string, query MessageQuery) ([]MessageInfo, error) {
+	var r []MessageInfo
+	endpoint := fmt.Sprintf("/channels/%s/messages", channelID)
+	if values := query.values(); len(values) != 0 {
+		endpoint += "?" + values.Encode()
+	}
+	err := bot.RESTCtx(ctx, "GET", endpoint, nil, &r)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return compareIDs(r[i].ID, r[j].ID) > 0
+	})
+	return r, nil
+}
+
+// compareIDs orders numeric IDs, which grow over time, without parsing them.
+func compareIDs(a string, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// MessageIterator pages through the history of a channel:
+//
+//	it := bot.MessageHistory(channelID, tomon.MessageQuery{})
+//	for it.Next(ctx) {
+//		msg := it.Message()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type MessageIterator struct {
+	bot       *Bot
+	channelID string
+	// forward is true when paging from After towards the newest message.
+	forward   bool
+	cursor    string
+	remaining int
+	page      []MessageInfo
+	current   *MessageInfo
+	done      bool
+	err       error
+}
+
+// MessageHistory returns an iterator over the messages of channelID. It walks backwards from
+// query.Before, or from the latest message, down to the first one. If only query.After is set,
+// it walks forwards from there to the latest message instead. query.Limit caps the total number
+// of messages, 0 means no cap. query.Around is not supported.
+func (bot *Bot) MessageHistory(channelID string, query MessageQuery) *MessageIterator {
+	it := &MessageIterator{bot: bot, channelID: channelID, remaining: query.Limit}
+	switch {
+	case query.Around != "":
+		it.err = errors.New("MessageHistory does not support Around")
+		it.done = true
+	case query.Before == "" && query.After != "":
+		it.forward = true
+		it.cursor = query.After
+	default:
+		it.cursor = query.Before
+	}
+	return it
+}
+
+// Next advances to the next message, fetching a page if needed. It returns false at the end of
+// the history or on error.
+func (it *MessageIterator) Next(ctx context.Context) bool {
+	if len(it.page) == 0 && !it.done {
+		it.fetch(ctx)
+	}
+	if len(it.page) == 0 || it.err != nil {
+		it.current = nil
+		return false
+	}
+	it.current = &it.page[0]
+	it.page = it.page[1:]
+	if it.remaining > 0 {
+		it.remaining--
+		if it.remaining == 0 {
+			it.page = nil
+			it.done = true
+		}
+	}
+	return true
+}
+
+func (it *MessageIterator) fetch(ctx context.Context) {
+	limit := MaxMessagesLimit
+	if it.remaining > 0 && it.remaining < limit {
+		limit = it.remaining
+	}
+	query := MessageQuery{Limit: limit}
+	if it.forward {
+		query.After = it.cursor
+	} else {
+		query.Before = it.cursor
+	}
+	page, err := it.bot.MessagesCtx(ctx, it.channelID, query)
+	if err != nil {
+		it.err = err
+		return
+	}
+	if len(page) < limit {
+		it.done = true
+	}
+	if len(page) == 0 {
+		return
+	}
+	if it.forward {
+		for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+			page[i], page[j] = page[j], page[i]
+		}
+	}
+	it.cursor = page[len(page)-1].ID
+	it.page = page
+}
+
+// Message returns the message Next advanced to.
+func (it *MessageIterator) Message() *MessageInfo {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *MessageIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,72 @@
+package tomon_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+// addHistory adds n messages to channelID, with IDs from 1 to n.
+func addHistory(server *tomontest.Server, channelID string, n int) {
+	msgs := make([]tomon.MessageInfo, n)
+	for i := range msgs {
+		msgs[i] = tomon.MessageInfo{ID: strconv.Itoa(i + 1), ChannelID: stringPtr(channelID), Content: stringPtr("")}
+	}
+	server.AddMessages(msgs...)
+}
+
+func collectHistory(t *testing.T, bot *tomon.Bot, channelID string, query tomon.MessageQuery) []string {
+	t.Helper()
+	var ids []string
+	it := bot.MessageHistory(channelID, query)
+	for it.Next(context.Background()) {
+		ids = append(ids, it.Message().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestMessageHistoryPages(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	addHistory(server, "20", 250)
+
+	page, err := bot.Messages("20", tomon.MessageQuery{Before: "101", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 10 || page[0].ID != "100" || page[9].ID != "91" {
+		t.Errorf("page before 101 is %v..., want 100 down to 91", page)
+	}
+
+	server.ResetRequests()
+	ids := collectHistory(t, bot, "20", tomon.MessageQuery{})
+	if len(ids) != 250 || ids[0] != "250" || ids[249] != "1" {
+		t.Fatalf("walked %d messages from %v, want 250 from the newest", len(ids), ids[:1])
+	}
+	if n := len(server.Requests()); n != 3 {
+		t.Errorf("walking 250 messages took %d requests, want 3", n)
+	}
+
+	ids = collectHistory(t, bot, "20", tomon.MessageQuery{After: "200"})
+	if len(ids) != 50 || ids[0] != "201" || ids[49] != "250" {
+		t.Errorf("walked %v after 200, want 201 up to 250", ids)
+	}
+
+	ids = collectHistory(t, bot, "20", tomon.MessageQuery{Before: "150", Limit: 120})
+	if len(ids) != 120 || ids[0] != "149" || ids[119] != "30" {
+		t.Errorf("walked %d messages before 150, want 120 from 149 down to 30", len(ids))
+	}
+
+	it := bot.MessageHistory("20", tomon.MessageQuery{Around: "10"})
+	if it.Next(context.Background()) || it.Err() == nil {
+		t.Error("Around should be refused")
+	}
+}
@@ -0,0 +1,159 @@
+package tomon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log entry.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// LevelOff disables logging when used as the minimum level of a logger.
+	LevelOff
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	case LevelOff:
+		return "off"
+	}
+	return "LogLevel(" + strconv.Itoa(int(level)) + ")"
+}
+
+// ParseLogLevel parses the name of a level as returned by LogLevel.String, ignoring case.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level := LevelDebug; level <= LevelOff; level++ {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return LevelOff, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger receives the log entries of a Bot. keyvals alternate between string keys and values.
+//
+// Payloads of gateway frames, which can contain private messages, are only logged at LevelDebug,
+// so implementations should report LevelDebug as disabled unless such output is acceptable.
+type Logger interface {
+	Enabled(level LogLevel) bool
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// NewTextLogger returns a Logger writing entries at level or above to w as lines of key=value pairs.
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{w: w, level: level}
+}
+
+// NewJSONLogger returns a Logger writing entries at level or above to w as JSON objects, one per line.
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{w: w, level: level, json: true}
+}
+
+// defaultLogger is used when Options.Logger is nil. It only reports errors.
+func defaultLogger() Logger {
+	return NewTextLogger(os.Stderr, LevelError)
+}
+
+type writerLogger struct {
+	mux   sync.Mutex
+	w     io.Writer
+	level LogLevel
+	json  bool
+}
+
+func (logger *writerLogger) Enabled(level LogLevel) bool {
+	return level >= logger.level && level < LevelOff
+}
+
+func (logger *writerLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+	now := time.Now().Format(time.RFC3339)
+	var line []byte
+	if logger.json {
+		entry := map[string]interface{}{"time": now, "level": level.String(), "msg": msg}
+		for i := 0; i < len(keyvals); i += 2 {
+			entry[logKey(keyvals, i)] = logValue(keyvals, i+1)
+		}
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(map[string]interface{}{"time": now, "level": level.String(), "msg": msg, "logError": err.Error()})
+		}
+	} else {
+		var builder strings.Builder
+		builder.WriteString(now)
+		builder.WriteByte(' ')
+		builder.WriteString(strings.ToUpper(level.String()))
+		builder.WriteByte(' ')
+		builder.WriteString(msg)
+		for i := 0; i < len(keyvals); i += 2 {
+			builder.WriteByte(' ')
+			builder.WriteString(logKey(keyvals, i))
+			builder.WriteByte('=')
+			value := fmt.Sprint(logValue(keyvals, i+1))
+			if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+				value = strconv.Quote(value)
+			}
+			builder.WriteString(value)
+		}
+		line = []byte(builder.String())
+	}
+	line = append(line, '\n')
+	logger.mux.Lock()
+	_, _ = logger.w.Write(line)
+	logger.mux.Unlock()
+}
+
+func logKey(keyvals []interface{}, i int) string {
+	if key, ok := keyvals[i].(string); ok {
+		return key
+	}
+	return fmt.Sprint(keyvals[i])
+}
+
+func logValue(keyvals []interface{}, i int) interface{} {
+	if i >= len(keyvals) {
+		return "(missing)"
+	}
+	switch v := keyvals[i].(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return keyvals[i]
+}
+
+// logInvalidPayload reports a gateway frame that could not be decoded. The payload is only
+// included at LevelDebug since it may contain message content.
+func (bot *Bot) logInvalidPayload(msg string, err error, name string, data []byte) {
+	keyvals := []interface{}{"err", err, "size", len(data)}
+	if name != "" {
+		keyvals = append(keyvals, "event", name)
+	}
+	if bot.options.Logger.Enabled(LevelDebug) {
+		keyvals = append(keyvals, "payload", string(data))
+	}
+	bot.options.Logger.Log(LevelWarn, msg, keyvals...)
+}
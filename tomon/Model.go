@@ -89,6 +89,23 @@ type ChannelInfo struct {
 	Topic                       string      `json:"topic,omitempty"`
 	Type                        int         `json:"type"`
 }
+
+// Channel types.
+const (
+	ChannelTypeText     = 0
+	ChannelTypeDM       = 1
+	ChannelTypeGroupDM  = 3
+	ChannelTypeCategory = 4
+)
+
+// IsPrivate reports whether channel is a DM or group DM rather than a guild channel.
+func (channel *ChannelInfo) IsPrivate() bool {
+	return channel.Type == ChannelTypeDM || channel.Type == ChannelTypeGroupDM
+}
+
+type createDMPayload struct {
+	RecipientID string `json:"recipient_id"`
+}
 type RoleInfo struct {
 	Color       int    `json:"color"`
 	GuildID     string `json:"guild_id"`
@@ -116,10 +133,20 @@ type gatewayIdentityRequest struct {
 	} `json:"d"`
 }
 
+type gatewayResumeRequest struct {
+	Op int `json:"op"`
+	D  struct {
+		Token     string `json:"token"`
+		SessionID string `json:"session_id"`
+		Sequence  int64  `json:"seq"`
+	} `json:"d"`
+}
+
 type gatewayNotification struct {
 	Op int             `json:"op"`
 	D  json.RawMessage `json:"d,omitempty"`
 	E  string          `json:"e,omitempty"`
+	S  int64           `json:"s,omitempty"`
 }
 
 type helloNotification struct {
@@ -135,8 +162,16 @@ type identityNotification struct {
 	} `json:"guilds"`
 }
 type sendMessagePayload struct {
+	Content string   `json:"content"`
+	Nonce   string   `json:"nonce"`
+	Stamps  []string `json:"stamps,omitempty"`
+	ReplyID string   `json:"reply_id,omitempty"`
+}
+type editMessagePayload struct {
 	Content string `json:"content"`
-	Nonce   string `json:"nonce"`
+}
+type bulkDeletePayload struct {
+	Messages []string `json:"messages"`
 }
 
 type MessageInfo struct {
@@ -167,12 +202,25 @@ type AttachmentInfo struct {
 	URL      string `json:"url"`
 }
 type ReactionInfo struct {
-	Emoji struct {
-		ID   *string `json:"id,omitempty"`
-		Name *string `json:"name,omitempty"`
-	} `json:"emoji"`
-	Count int  `json:"count"`
-	Me    bool `json:"me"`
+	Emoji ReactionEmoji `json:"emoji"`
+	Count int           `json:"count"`
+	Me    bool          `json:"me"`
+}
+
+// ReactionEmoji is a unicode emoji, which only has a Name, or a custom emoji.
+type ReactionEmoji struct {
+	ID   *string `json:"id,omitempty"`
+	Name *string `json:"name,omitempty"`
+}
+
+// MessageReactionInfo is the payload of reaction events.
+type MessageReactionInfo struct {
+	UserID    string        `json:"user_id"`
+	ChannelID string        `json:"channel_id"`
+	MessageID string        `json:"message_id"`
+	GuildID   string        `json:"guild_id,omitempty"`
+	Emoji     ReactionEmoji `json:"emoji"`
+	Member    *MemberInfo   `json:"member,omitempty"`
 }
 type StampsInfo struct {
 	ID        string     `json:"id"`
@@ -187,7 +235,36 @@ type StampsInfo struct {
 	Height    int        `json:"height"`
 	UpdatedAt *time.Time `json:"updated_at"`
 }
+type StampPackInfo struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	AuthorID  string       `json:"author_id"`
+	Stamps    []StampsInfo `json:"stamps"`
+	UpdatedAt *time.Time   `json:"updated_at"`
+}
+
+// MaxMessageFiles is the maximum number of files in one message.
+const MaxMessageFiles = 10
+
+// MaxBulkDelete is the maximum number of messages deleted by one bulk delete request.
+const MaxBulkDelete = 100
+
+// MessageSend is a message to create. Files are shown after Content.
+type MessageSend struct {
+	Content string
+	Files   []ReaderWithName
+	// Stamps are the IDs of the stamps to send, see Bot.StampPacks.
+	Stamps []string
+	// ReplyID is the ID of the message this one replies to, in the same channel.
+	ReplyID string
+	// Progress, if not nil, is called while Files are uploaded.
+	Progress UploadProgress
+}
 type ReaderWithName struct {
 	Reader io.Reader
 	Name   string
+	// Size is the number of bytes Reader yields, or 0 if unknown. It is found out from Reader
+	// when possible, e.g. for *bytes.Reader and *os.File. If the size of every file is known,
+	// uploads are sent with a Content-Length and checked against Options.MaxUploadSize before sending.
+	Size int64
 }
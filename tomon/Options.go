@@ -0,0 +1,63 @@
+package tomon
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Options customizes how a Bot talks to Tomon. Zero values fall back to the public Tomon service.
+type Options struct {
+	// BaseURL is the root of the REST API, without a trailing slash. Defaults to BaseURL.
+	BaseURL string
+	// GatewayURL is the websocket gateway address. Defaults to GatewayURL.
+	GatewayURL string
+	// HTTPClient is used for every REST request. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Dialer is used to connect to the gateway. Defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// UserAgent is sent with REST requests and the gateway handshake if not empty.
+	UserAgent string
+	// MaxRateLimitRetries is how many times a rate limited REST request is sent again before giving up.
+	// Defaults to 5; set it to a negative value to disable retries.
+	MaxRateLimitRetries int
+	// ReconnectPolicy controls how the gateway connection is retried. Defaults to DefaultReconnectPolicy().
+	ReconnectPolicy *ReconnectPolicy
+	// MaxUploadSize limits the total size of the files of a message, 0 means no limit. Files
+	// of unknown size are cut off once they exceed it.
+	MaxUploadSize int64
+	// CatchUpMessages enables fetching the messages missed while disconnected, when the session
+	// could not be resumed and the bot had to identify again. They are delivered as MessageCreate
+	// events, oldest first, before any new event. It is the maximum number of messages fetched per
+	// channel; 0 disables catching up. A catch-up pass holds up heartbeat acknowledgements, so it is
+	// cut short after a quarter of the heartbeat interval, or 10 seconds at most.
+	CatchUpMessages int
+	// Logger receives what the Bot has to report. Defaults to a logger writing only errors to stderr.
+	Logger Logger
+}
+
+func (options Options) withDefaults() Options {
+	if options.BaseURL == "" {
+		options.BaseURL = BaseURL
+	}
+	if options.GatewayURL == "" {
+		options.GatewayURL = GatewayURL
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	if options.Dialer == nil {
+		options.Dialer = websocket.DefaultDialer
+	}
+	if options.ReconnectPolicy == nil {
+		policy := DefaultReconnectPolicy()
+		options.ReconnectPolicy = &policy
+	}
+	if options.Logger == nil {
+		options.Logger = defaultLogger()
+	}
+	if options.MaxRateLimitRetries == 0 {
+		options.MaxRateLimitRetries = defaultMaxRateLimitRetries
+	}
+	return options
+}
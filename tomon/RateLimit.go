@@ -0,0 +1,254 @@
+package tomon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMaxRateLimitRetries = 5
+const defaultRetryAfter = time.Second
+
+// RateLimitStats counts how often REST requests were slowed down by Tomon's rate limits.
+type RateLimitStats struct {
+	// Throttled is the number of 429 responses received.
+	Throttled uint64
+	// Retried is the number of requests sent again after a 429 response.
+	Retried uint64
+	// Delayed is the number of requests held back because their bucket was known to be exhausted.
+	Delayed uint64
+	// Routes is the number of 429 responses received per route, e.g. "POST /channels/{id}/messages".
+	Routes map[string]uint64
+}
+
+type rateBucket struct {
+	// queue holds a token while a request of the bucket is in flight, so that they are sent one by one.
+	queue     chan struct{}
+	remaining int
+	reset     time.Time
+}
+
+func (b *rateBucket) acquire(ctx context.Context) error {
+	select {
+	case b.queue <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *rateBucket) release() {
+	<-b.queue
+}
+
+type rateLimiter struct {
+	// counters first for 64-bit alignment of atomic operations
+	throttled uint64
+	retried   uint64
+	delayed   uint64
+	mux       sync.Mutex
+	buckets   map[string]*rateBucket
+	global    time.Time
+	routes    map[string]uint64
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*rateBucket),
+		routes:  make(map[string]uint64),
+	}
+}
+
+// Route returns the route of a REST endpoint relative to BaseURL, with IDs replaced the way
+// requests are grouped for rate limiting, e.g. /channels/123/messages/{id}.
+// It is meant for labelling metrics without one series per message or user.
+func Route(endpoint string) string {
+	return routeOf(endpoint)
+}
+
+// routeOf replaces every ID in endpoint except the top-level channel or guild ID with {id},
+// and reaction emojis with {emoji}, so that requests sharing a Tomon rate limit bucket share a route.
+func routeOf(endpoint string) string {
+	if i := strings.IndexByte(endpoint, '?'); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	segments := strings.Split(endpoint, "/")
+	for i, segment := range segments {
+		if i > 0 && segments[i-1] == "reactions" {
+			segments[i] = "{emoji}"
+			continue
+		}
+		if !isID(segment) {
+			continue
+		}
+		if i == 2 && (segments[1] == "channels" || segments[1] == "guilds") {
+			continue
+		}
+		segments[i] = "{id}"
+	}
+	return strings.Join(segments, "/")
+}
+
+func isID(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	for _, c := range segment {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (limiter *rateLimiter) bucket(key string) *rateBucket {
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &rateBucket{queue: make(chan struct{}, 1), remaining: 1}
+		limiter.buckets[key] = b
+	}
+	return b
+}
+
+// delay returns how long a request in b has to wait before it may be sent.
+// The caller must have acquired b.
+func (limiter *rateLimiter) delay(b *rateBucket) time.Duration {
+	now := time.Now()
+	var d time.Duration
+	limiter.mux.Lock()
+	if limiter.global.After(now) {
+		d = limiter.global.Sub(now)
+	}
+	limiter.mux.Unlock()
+	if b.remaining <= 0 && b.reset.After(now) {
+		if bd := b.reset.Sub(now); bd > d {
+			d = bd
+		}
+	}
+	if d > 0 {
+		atomic.AddUint64(&limiter.delayed, 1)
+	}
+	return d
+}
+
+// update records the rate limit headers of a response. The caller must have acquired b.
+func (limiter *rateLimiter) update(b *rateBucket, header http.Header) {
+	if remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining")); err == nil {
+		b.remaining = remaining
+	} else {
+		b.remaining = 1
+	}
+	if resetAfter, ok := parseSeconds(header.Get("X-RateLimit-Reset-After")); ok {
+		b.reset = time.Now().Add(resetAfter)
+	} else if reset, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset"), 64); err == nil {
+		b.reset = time.Unix(0, int64(reset*float64(time.Second)))
+	}
+}
+
+// throttle records a 429 response for route and returns how long to wait before retrying.
+// The caller must have acquired b.
+func (limiter *rateLimiter) throttle(b *rateBucket, route string, resp *http.Response, body []byte) time.Duration {
+	atomic.AddUint64(&limiter.throttled, 1)
+	retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if !ok {
+		var payload struct {
+			RetryAfter float64 `json:"retry_after"`
+		}
+		if json.Unmarshal(body, &payload) == nil && payload.RetryAfter > 0 {
+			retryAfter, ok = time.Duration(payload.RetryAfter*float64(time.Second)), true
+		}
+	}
+	if !ok {
+		retryAfter = defaultRetryAfter
+	}
+	limiter.mux.Lock()
+	limiter.routes[route]++
+	if strings.EqualFold(resp.Header.Get("X-RateLimit-Global"), "true") {
+		limiter.global = time.Now().Add(retryAfter)
+	}
+	limiter.mux.Unlock()
+	b.remaining = 0
+	b.reset = time.Now().Add(retryAfter)
+	return retryAfter
+}
+
+func (limiter *rateLimiter) stats() RateLimitStats {
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+	r := RateLimitStats{
+		Throttled: atomic.LoadUint64(&limiter.throttled),
+		Retried:   atomic.LoadUint64(&limiter.retried),
+		Delayed:   atomic.LoadUint64(&limiter.delayed),
+		Routes:    make(map[string]uint64, len(limiter.routes)),
+	}
+	for route, count := range limiter.routes {
+		r.Routes[route] = count
+	}
+	return r
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func parseSeconds(s string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+func parseRetryAfter(s string) (time.Duration, bool) {
+	if d, ok := parseSeconds(s); ok {
+		return d, true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// replayable returns a function producing content from the start on every call,
+// or nil if content cannot be read more than once.
+func replayable(content io.Reader) func() io.Reader {
+	switch v := content.(type) {
+	case nil:
+		return func() io.Reader { return nil }
+	case *uploadReader:
+		return v.upload.replay()
+	case *bytes.Buffer:
+		buf := v.Bytes()
+		return func() io.Reader { return bytes.NewReader(buf) }
+	case io.ReadSeeker:
+		start, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil
+		}
+		return func() io.Reader {
+			_, _ = v.Seek(start, io.SeekStart)
+			return v
+		}
+	}
+	return nil
+}
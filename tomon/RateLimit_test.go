@@ -0,0 +1,64 @@
+package tomon_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+// rateLimitFirst answers 429 to the first n calls and a created message to the others.
+func rateLimitFirst(n int32) http.HandlerFunc {
+	var calls int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&calls, 1) <= n {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message":"You are being rate limited.","retry_after":0.01}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(tomon.MessageInfo{ID: "1", ChannelID: stringPtr(tomontest.Var(r, "channel"))})
+	}
+}
+
+func TestRateLimitedRequestIsRetried(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	server.HandleFunc("POST", "/channels/{channel}/messages", rateLimitFirst(2))
+	server.ResetRequests()
+
+	_, err := bot.CreateMessage("20", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Requests()); n != 3 {
+		t.Errorf("server got %d requests, want 3", n)
+	}
+	stats := bot.RateLimitStats()
+	if stats.Throttled != 2 || stats.Retried != 2 {
+		t.Errorf("stats are %+v, want 2 throttled and 2 retried", stats)
+	}
+	if n := stats.Routes["POST /channels/20/messages"]; n != 2 {
+		t.Errorf("route was throttled %d times, want 2; routes are %v", n, stats.Routes)
+	}
+}
+
+func TestRateLimitRetriesCanBeDisabled(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	options := testOptions(server)
+	options.MaxRateLimitRetries = -1
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	server.HandleFunc("POST", "/channels/{channel}/messages", rateLimitFirst(1))
+
+	_, err := bot.CreateMessage("20", "hi")
+	if !tomon.IsRateLimited(err) {
+		t.Fatalf("got %v, want a rate limit error", err)
+	}
+}
@@ -0,0 +1,58 @@
+package tomon
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// String returns the form of emoji expected by the reaction methods: the emoji itself for
+// a unicode emoji, or name:id for a custom emoji.
+func (emoji ReactionEmoji) String() string {
+	var name string
+	if emoji.Name != nil {
+		name = *emoji.Name
+	}
+	if emoji.ID != nil && *emoji.ID != "" {
+		return name + ":" + *emoji.ID
+	}
+	return name
+}
+
+func reactionEndpoint(channelID string, messageID string, emoji string) string {
+	return fmt.Sprintf("/channels/%s/messages/%s/reactions/%s", channelID, messageID, url.PathEscape(emoji))
+}
+
+func (bot *Bot) AddReaction(channelID string, messageID string, emoji string) error {
+	return bot.AddReactionCtx(context.Background(), channelID, messageID, emoji)
+}
+
+// AddReactionCtx reacts to a message as the bot. emoji is a unicode emoji or name:id for a custom emoji,
+// see ReactionEmoji.String.
+func (bot *Bot) AddReactionCtx(ctx context.Context, channelID string, messageID string, emoji string) error {
+	return bot.RESTCtx(ctx, "PUT", reactionEndpoint(channelID, messageID, emoji)+"/@me", nil, nil)
+}
+func (bot *Bot) RemoveReaction(channelID string, messageID string, emoji string, userID string) error {
+	return bot.RemoveReactionCtx(context.Background(), channelID, messageID, emoji, userID)
+}
+
+// RemoveReactionCtx removes the reaction of userID, or of the bot if userID is empty.
+func (bot *Bot) RemoveReactionCtx(ctx context.Context, channelID string, messageID string, emoji string, userID string) error {
+	if userID == "" {
+		userID = "@me"
+	}
+	return bot.RESTCtx(ctx, "DELETE", reactionEndpoint(channelID, messageID, emoji)+"/"+userID, nil, nil)
+}
+func (bot *Bot) ListReactionUsers(channelID string, messageID string, emoji string) ([]UserInfo, error) {
+	return bot.ListReactionUsersCtx(context.Background(), channelID, messageID, emoji)
+}
+
+// ListReactionUsersCtx returns the users who reacted to a message with emoji.
+func (bot *Bot) ListReactionUsersCtx(ctx context.Context, channelID string, messageID string, emoji string) ([]UserInfo, error) {
+	var r []UserInfo
+	err := bot.RESTCtx(ctx, "GET", reactionEndpoint(channelID, messageID, emoji), nil, &r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,73 @@
+package tomon
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy decides how long a Bot waits before connecting to the gateway again.
+// The delay starts at InitialDelay and is multiplied by Multiplier after every failed attempt,
+// up to MaxDelay, then randomized by up to ±Jitter of itself.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	// Jitter is a fraction between 0 and 1.
+	Jitter float64
+	// MaxAttempts is how many consecutive failed attempts are made before the Bot gives up and closes.
+	// 0 means the Bot never gives up, in which case New does not return until the first connection
+	// succeeds unless MaxInitialAttempts is set.
+	MaxAttempts int
+	// MaxInitialAttempts replaces MaxAttempts until the Bot is ready for the first time, so that New
+	// can fail while a Bot that once connected keeps retrying. 0 means MaxAttempts applies.
+	MaxInitialAttempts int
+}
+
+// DefaultReconnectPolicy is used when Options.ReconnectPolicy is nil.
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+		MaxAttempts:  5,
+	}
+}
+
+// maxAttempts returns the number of consecutive failed attempts to give up after, 0 for none.
+func (policy *ReconnectPolicy) maxAttempts(connected bool) int {
+	if !connected && policy.MaxInitialAttempts > 0 {
+		return policy.MaxInitialAttempts
+	}
+	return policy.MaxAttempts
+}
+
+// delay returns how long to wait after failures consecutive failed attempts.
+func (policy *ReconnectPolicy) delay(failures int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(policy.InitialDelay) * math.Pow(multiplier, float64(failures))
+	if policy.MaxDelay > 0 && d > float64(policy.MaxDelay) {
+		d = float64(policy.MaxDelay)
+	}
+	if policy.Jitter > 0 {
+		d += d * policy.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Reconnecting is emitted when the gateway connection is lost or could not be established,
+// before waiting Delay for attempt number Attempt.
+type Reconnecting struct {
+	Attempt int
+	Delay   time.Duration
+}
+
+// Reconnected is emitted once the Bot has identified or resumed again after losing the connection.
+type Reconnected struct{}
+
+func (*Reconnecting) EventName() string { return "RECONNECTING" }
+func (*Reconnected) EventName() string  { return "RECONNECTED" }
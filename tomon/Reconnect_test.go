@@ -0,0 +1,82 @@
+package tomon_test
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+	"github.com/gorilla/websocket"
+)
+
+// failingDialer returns a dialer that cannot reach the gateway while *failing is not 0.
+func failingDialer(failing *int32) *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDial: func(network string, addr string) (net.Conn, error) {
+			if atomic.LoadInt32(failing) != 0 {
+				return nil, errors.New("gateway unreachable")
+			}
+			return net.Dial(network, addr)
+		},
+	}
+}
+
+func TestMaxInitialAttemptsBoundsTheFirstConnection(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	failing := int32(1)
+	options := testOptions(server)
+	options.Dialer = failingDialer(&failing)
+	options.ReconnectPolicy.MaxAttempts = 0
+	options.ReconnectPolicy.MaxInitialAttempts = 2
+
+	result := make(chan error, 1)
+	go func() {
+		bot, err := tomon.NewWithOptions(&tomon.LoginByToken{Token: server.Token}, options)
+		if err == nil {
+			bot.Close()
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("connected to an unreachable gateway")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("New kept retrying past MaxInitialAttempts")
+	}
+}
+
+func TestMaxAttemptsAppliesOnceConnected(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	var failing int32
+	options := testOptions(server)
+	options.Dialer = failingDialer(&failing)
+	options.ReconnectPolicy.MaxAttempts = 0
+	options.ReconnectPolicy.MaxInitialAttempts = 2
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	attempts := make(chan int, 16)
+	bot.AddHandler(func(e *tomon.Reconnecting) {
+		attempts <- e.Attempt
+	})
+	states := recordStates(bot)
+
+	atomic.StoreInt32(&failing, 1)
+	server.DropConnections()
+	timeout := time.After(5 * time.Second)
+	for attempt := 0; attempt <= options.ReconnectPolicy.MaxInitialAttempts+1; {
+		select {
+		case attempt = <-attempts:
+		case <-timeout:
+			t.Fatal("stopped retrying after losing the connection")
+		}
+	}
+	atomic.StoreInt32(&failing, 0)
+	waitStates(t, states, tomon.StateReady)
+}
@@ -0,0 +1,124 @@
+package tomon_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+// testOptions returns the options of server with reconnects fast enough for tests.
+func testOptions(server *tomontest.Server) tomon.Options {
+	options := server.Options()
+	options.ReconnectPolicy = &tomon.ReconnectPolicy{
+		InitialDelay: 10 * time.Millisecond,
+		MaxDelay:     100 * time.Millisecond,
+		Multiplier:   2,
+		MaxAttempts:  5,
+	}
+	return options
+}
+
+// connectTestBot logs a bot in to server and waits for it to identify.
+func connectTestBot(t *testing.T, server *tomontest.Server, options tomon.Options) *tomon.Bot {
+	t.Helper()
+	bot, err := tomon.NewWithOptions(&tomon.LoginByToken{Token: server.Token}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WaitReady(5 * time.Second); err != nil {
+		bot.Close()
+		t.Fatal(err)
+	}
+	return bot
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// recordStates returns a channel receiving the states bot moves to.
+func recordStates(bot *tomon.Bot) chan tomon.ConnectionState {
+	states := make(chan tomon.ConnectionState, 32)
+	bot.AddHandler(func(e *tomon.StateChange) {
+		states <- e.New
+	})
+	return states
+}
+
+// waitStates fails t unless the states received from states include want in order, up to the last one.
+func waitStates(t *testing.T, states chan tomon.ConnectionState, want ...tomon.ConnectionState) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for len(want) != 0 {
+		select {
+		case state := <-states:
+			if state == want[0] {
+				want = want[1:]
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %v", want[0])
+		}
+	}
+}
+
+func TestResumeReplaysMissedDispatches(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	states := recordStates(bot)
+	received := make(chan string, 4)
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		received <- *e.Content
+	})
+
+	server.DropConnections()
+	err := server.DispatchMessageCreate(tomon.MessageInfo{ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("missed")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStates(t, states, tomon.StateResuming, tomon.StateReady)
+	select {
+	case content := <-received:
+		if content != "missed" {
+			t.Errorf("received %q, want the missed message", content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the missed message was not replayed")
+	}
+	select {
+	case content := <-received:
+		t.Errorf("received %q twice", content)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInvalidSessionIdentifiesAgain(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	states := recordStates(bot)
+
+	server.InvalidateSessions()
+	server.DropConnections()
+	waitStates(t, states, tomon.StateResuming, tomon.StateIdentifying, tomon.StateReady)
+	if err := server.WaitReady(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		received <- *e.Content
+	})
+	err := server.DispatchMessageCreate(tomon.MessageInfo{ChannelID: stringPtr("20"), Author: &tomon.UserInfo{ID: "30"}, Content: stringPtr("new session")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dispatch received on the new session")
+	}
+}
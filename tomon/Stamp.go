@@ -0,0 +1,112 @@
+package tomon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// stampRefreshInterval is how often StampCtx may fetch the stamp packs again to look for a stamp
+// it does not know, so that messages with stamps of other users do not each cost a request.
+const stampRefreshInterval = time.Minute
+
+// stampCache holds the stamp packs of the bot, fetched on first use.
+type stampCache struct {
+	mux      sync.Mutex
+	loaded   bool
+	loadedAt time.Time
+	packs    []StampPackInfo
+	stamps   map[string]StampsInfo
+}
+
+func (cache *stampCache) set(packs []StampPackInfo) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	cache.loaded = true
+	cache.loadedAt = time.Now()
+	cache.packs = packs
+	cache.stamps = make(map[string]StampsInfo)
+	for _, pack := range packs {
+		for _, stamp := range pack.Stamps {
+			cache.stamps[stamp.ID] = stamp
+		}
+	}
+}
+
+func (cache *stampCache) get() ([]StampPackInfo, bool) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	return append([]StampPackInfo(nil), cache.packs...), cache.loaded
+}
+
+func (cache *stampCache) stamp(stampID string) (StampsInfo, bool) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	r, ok := cache.stamps[stampID]
+	return r, ok
+}
+
+// stale reports whether the packs are not loaded yet or were loaded long enough ago to be
+// fetched again for a missing stamp.
+func (cache *stampCache) stale() bool {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	return !cache.loaded || time.Since(cache.loadedAt) >= stampRefreshInterval
+}
+
+func (bot *Bot) StampPacks() ([]StampPackInfo, error) {
+	return bot.StampPacksCtx(context.Background())
+}
+
+// StampPacksCtx returns the stamp packs the bot can send from. They are fetched once and cached,
+// call RefreshStampPacksCtx to pick up changes.
+func (bot *Bot) StampPacksCtx(ctx context.Context) ([]StampPackInfo, error) {
+	if packs, ok := bot.stamps.get(); ok {
+		return packs, nil
+	}
+	return bot.RefreshStampPacksCtx(ctx)
+}
+func (bot *Bot) RefreshStampPacks() ([]StampPackInfo, error) {
+	return bot.RefreshStampPacksCtx(context.Background())
+}
+
+// RefreshStampPacksCtx fetches the stamp packs again and updates the cache.
+func (bot *Bot) RefreshStampPacksCtx(ctx context.Context) ([]StampPackInfo, error) {
+	var r []StampPackInfo
+	err := bot.RESTCtx(ctx, "GET", "/users/@me/stamp-packs", nil, &r)
+	if err != nil {
+		return nil, err
+	}
+	bot.stamps.set(r)
+	packs, _ := bot.stamps.get()
+	return packs, nil
+}
+func (bot *Bot) Stamp(stampID string) (StampsInfo, error) {
+	return bot.StampCtx(context.Background(), stampID)
+}
+
+// StampCtx looks up a stamp in the packs of the bot. If it is not found, the packs are fetched
+// again, unless they were fetched less than a minute ago.
+func (bot *Bot) StampCtx(ctx context.Context, stampID string) (StampsInfo, error) {
+	if stamp, ok := bot.stamps.stamp(stampID); ok {
+		return stamp, nil
+	}
+	if bot.stamps.stale() {
+		_, err := bot.RefreshStampPacksCtx(ctx)
+		if err != nil {
+			return StampsInfo{}, err
+		}
+	}
+	stamp, ok := bot.stamps.stamp(stampID)
+	if !ok {
+		return StampsInfo{}, fmt.Errorf("unknown stamp %s", stampID)
+	}
+	return stamp, nil
+}
+func (bot *Bot) CreateStampMessage(channelID string, stampIDs []string) (*MessageInfo, error) {
+	return bot.CreateStampMessageCtx(context.Background(), channelID, stampIDs)
+}
+func (bot *Bot) CreateStampMessageCtx(ctx context.Context, channelID string, stampIDs []string) (*MessageInfo, error) {
+	return bot.SendMessageCtx(ctx, channelID, MessageSend{Stamps: stampIDs})
+}
@@ -0,0 +1,35 @@
+package tomon_test
+
+import (
+	"testing"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+func TestStampFetchesPacksSparingly(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	server.StampPacks = []tomon.StampPackInfo{{ID: "1", Stamps: []tomon.StampsInfo{{ID: "10", PackID: "1"}}}}
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	server.ResetRequests()
+
+	if _, err := bot.Stamp("11"); err == nil {
+		t.Error("found a stamp the bot does not have")
+	}
+	if n := len(server.Requests()); n != 1 {
+		t.Errorf("looking up an unknown stamp took %d requests, want 1", n)
+	}
+	for _, stampID := range []string{"11", "12"} {
+		if _, err := bot.Stamp(stampID); err == nil {
+			t.Errorf("found stamp %s the bot does not have", stampID)
+		}
+	}
+	if stamp, err := bot.Stamp("10"); err != nil || stamp.PackID != "1" {
+		t.Errorf("got stamp %+v, %v, want stamp 10 of pack 1", stamp, err)
+	}
+	if n := len(server.Requests()); n != 1 {
+		t.Errorf("the packs were fetched %d times, want once", n)
+	}
+}
@@ -0,0 +1,225 @@
+package tomon
+
+import "sync"
+
+// stateStore caches the guilds, channels and members announced by the gateway.
+// It is written by the gateway goroutine and may be read from any goroutine, so every
+// accessor returns copies instead of the maps it owns.
+type stateStore struct {
+	mux             sync.RWMutex
+	guilds          map[string]GuildInfo             //[GuildID]
+	channels        map[string]ChannelInfo           //[ChannelID]
+	members         map[string]map[string]MemberInfo //[GuildID][MemberID]
+	channelsInGuild map[string]map[string]int        //[GuildID][ChannelID]
+	dmChannels      map[string]string                //[UserID]ChannelID
+}
+
+func newStateStore() *stateStore {
+	store := new(stateStore)
+	store.reset()
+	return store
+}
+
+func (store *stateStore) reset() {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.guilds = make(map[string]GuildInfo)
+	store.channels = make(map[string]ChannelInfo)
+	store.members = make(map[string]map[string]MemberInfo)
+	store.channelsInGuild = make(map[string]map[string]int)
+	store.dmChannels = make(map[string]string)
+}
+
+// load replaces the whole state with the one sent in reply to IDENTITY.
+func (store *stateStore) load(data *identityNotification) {
+	store.reset()
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	for _, dmChannel := range data.DMChannels {
+		store.putChannel(dmChannel)
+	}
+	for _, guild := range data.Guilds {
+		store.guilds[guild.ID] = guild.GuildInfo
+		for _, channel := range guild.Channels {
+			store.putChannel(channel)
+		}
+		for _, member := range guild.Members {
+			store.putMember(member)
+		}
+	}
+}
+
+func (store *stateStore) setGuild(info GuildInfo) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.guilds[info.ID] = info
+}
+
+func (store *stateStore) removeGuild(guildID string) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	for channelID := range store.channelsInGuild[guildID] {
+		delete(store.channels, channelID)
+	}
+	delete(store.guilds, guildID)
+	delete(store.channelsInGuild, guildID)
+	delete(store.members, guildID)
+}
+
+func (store *stateStore) guild(guildID string) (GuildInfo, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	r, ok := store.guilds[guildID]
+	return r, ok
+}
+
+func (store *stateStore) allGuilds() map[string]GuildInfo {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	r := make(map[string]GuildInfo, len(store.guilds))
+	for id, guild := range store.guilds {
+		r[id] = guild
+	}
+	return r
+}
+
+func (store *stateStore) setChannel(info ChannelInfo) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.putChannel(info)
+}
+
+// putChannel stores info. The caller must hold store.mux for writing.
+func (store *stateStore) putChannel(info ChannelInfo) {
+	store.channels[info.ID] = info
+	if info.Type == ChannelTypeDM {
+		for _, recipient := range info.Recipients {
+			store.dmChannels[recipient.ID] = info.ID
+		}
+	}
+	if info.GuildID == "" {
+		return
+	}
+	cpg, ok := store.channelsInGuild[info.GuildID]
+	if !ok {
+		cpg = make(map[string]int)
+		store.channelsInGuild[info.GuildID] = cpg
+	}
+	cpg[info.ID] = 0
+}
+
+func (store *stateStore) removeChannel(info ChannelInfo) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	delete(store.channels, info.ID)
+	if cpg, ok := store.channelsInGuild[info.GuildID]; ok {
+		delete(cpg, info.ID)
+	}
+	for userID, channelID := range store.dmChannels {
+		if channelID == info.ID {
+			delete(store.dmChannels, userID)
+		}
+	}
+}
+
+// dmChannel returns the DM channel with userID.
+func (store *stateStore) dmChannel(userID string) (ChannelInfo, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	channelID, ok := store.dmChannels[userID]
+	if !ok {
+		return ChannelInfo{}, false
+	}
+	r, ok := store.channels[channelID]
+	return r, ok
+}
+
+func (store *stateStore) channel(channelID string) (ChannelInfo, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	r, ok := store.channels[channelID]
+	return r, ok
+}
+
+func (store *stateStore) allChannels() map[string]ChannelInfo {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	r := make(map[string]ChannelInfo, len(store.channels))
+	for id, channel := range store.channels {
+		r[id] = channel
+	}
+	return r
+}
+
+func (store *stateStore) channelIDsInGuild(guildID string) (map[string]int, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	cpg, ok := store.channelsInGuild[guildID]
+	if !ok {
+		return nil, false
+	}
+	r := make(map[string]int, len(cpg))
+	for id, v := range cpg {
+		r[id] = v
+	}
+	return r, true
+}
+
+func (store *stateStore) setMember(info MemberInfo) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	store.putMember(info)
+}
+
+// putMember stores info. The caller must hold store.mux for writing.
+func (store *stateStore) putMember(info MemberInfo) {
+	ms, ok := store.members[info.GuildID]
+	if !ok {
+		ms = make(map[string]MemberInfo)
+		store.members[info.GuildID] = ms
+	}
+	ms[info.User.ID] = info
+}
+
+func (store *stateStore) removeMember(guildID string, userID string) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	delete(store.members[guildID], userID)
+}
+
+func (store *stateStore) member(guildID string, userID string) (MemberInfo, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	r, ok := store.members[guildID][userID]
+	return r, ok
+}
+
+func (store *stateStore) guildMembers(guildID string) map[string]MemberInfo {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	ms := store.members[guildID]
+	r := make(map[string]MemberInfo, len(ms))
+	for id, member := range ms {
+		r[id] = member
+	}
+	return r
+}
+
+// user looks for userID among DM recipients and guild members.
+func (store *stateStore) user(userID string) (UserInfo, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	for _, channel := range store.channels {
+		for _, recipient := range channel.Recipients {
+			if recipient.ID == userID {
+				return recipient, true
+			}
+		}
+	}
+	for _, ms := range store.members {
+		if r, ok := ms[userID]; ok {
+			return r.User, true
+		}
+	}
+	return UserInfo{}, false
+}
@@ -0,0 +1,146 @@
+package tomon_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+// TestStateAccessorsDuringDispatch reads the cached state from several goroutines while the
+// gateway keeps changing it. Run it with -race.
+func TestStateAccessorsDuringDispatch(t *testing.T) {
+	const guildID = "100"
+	server := tomontest.NewServer()
+	defer server.Close()
+	server.Identity.Guilds = []tomontest.IdentityGuild{{
+		GuildInfo: tomon.GuildInfo{ID: guildID, Name: "guild"},
+		Channels:  []tomon.ChannelInfo{{ID: "200", GuildID: guildID, Name: "general"}},
+		Members:   []tomon.MemberInfo{{GuildID: guildID, User: tomon.UserInfo{ID: "300", Name: "member"}}},
+	}}
+	bot, err := tomon.NewWithOptions(&tomon.LoginByToken{Token: server.Token}, server.Options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+
+	const rounds = 200
+	done := make(chan struct{})
+	bot.AddHandler(func(e *tomon.ChannelCreate) {
+		if e.ID == "end" {
+			close(done)
+		}
+	})
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for id, channel := range bot.Channels() {
+					if id != channel.ID {
+						t.Errorf("channel %s is stored as %s", channel.ID, id)
+					}
+				}
+				_, _ = bot.User("300")
+				for id, member := range bot.Members(guildID) {
+					if id != member.User.ID {
+						t.Errorf("member %s is stored as %s", member.User.ID, id)
+					}
+				}
+				_, _ = bot.Member(guildID, "300")
+				_, _ = bot.ChannelsInGuild(guildID)
+				_ = bot.Guilds()
+			}
+		}()
+	}
+
+	for i := 0; i < rounds; i++ {
+		channel := tomon.ChannelInfo{ID: fmt.Sprint(1000 + i), GuildID: guildID, Name: "channel"}
+		member := tomon.MemberInfo{GuildID: guildID, User: tomon.UserInfo{ID: fmt.Sprint(2000 + i), Name: "user"}}
+		for _, d := range []struct {
+			event string
+			data  interface{}
+		}{
+			{"GUILD_UPDATE", tomon.GuildInfo{ID: guildID, Name: fmt.Sprint("guild ", i)}},
+			{"CHANNEL_CREATE", channel},
+			{"CHANNEL_UPDATE", channel},
+			{"GUILD_MEMBER_ADD", member},
+			{"GUILD_MEMBER_UPDATE", member},
+			{"CHANNEL_DELETE", channel},
+			{"GUILD_MEMBER_REMOVE", member},
+		} {
+			if err := server.Dispatch(d.event, d.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := server.Dispatch("CHANNEL_CREATE", tomon.ChannelInfo{ID: "end", GuildID: guildID}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the dispatched events")
+	}
+	close(stop)
+	readers.Wait()
+
+	channels, err := bot.ChannelsInGuild(guildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 {
+		t.Errorf("guild has %d channels after the events, want 2", len(channels))
+	}
+	if members := bot.Members(guildID); len(members) != 1 {
+		t.Errorf("guild has %d members after the events, want 1", len(members))
+	}
+	if guild, ok := bot.Guild(guildID); !ok || guild.Name != fmt.Sprint("guild ", rounds-1) {
+		t.Errorf("guild is %+v, want the last update", guild)
+	}
+}
+
+func TestChannelCachesFetchedDMChannels(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	server.HandleFunc("GET", "/channels/{channel}", func(w http.ResponseWriter, r *http.Request) {
+		channel := tomon.ChannelInfo{ID: tomontest.Var(r, "channel"), Type: tomon.ChannelTypeDM}
+		if channel.ID == "guild-channel" {
+			channel = tomon.ChannelInfo{ID: channel.ID, GuildID: "100", Type: tomon.ChannelTypeText}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(channel)
+	})
+
+	if _, ok := bot.CachedChannel("dm"); ok {
+		t.Fatal("the DM channel is cached before it was fetched")
+	}
+	if _, err := bot.Channel("dm"); err != nil {
+		t.Fatal(err)
+	}
+	if channel, ok := bot.CachedChannel("dm"); !ok || channel.Type != tomon.ChannelTypeDM {
+		t.Errorf("the fetched DM channel is not cached, got %+v", channel)
+	}
+
+	if _, err := bot.Channel("guild-channel"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bot.CachedChannel("guild-channel"); ok {
+		t.Error("a guild channel was cached apart from its guild")
+	}
+}
@@ -0,0 +1,182 @@
+package tomon
+
+import (
+	"sync"
+	"time"
+)
+
+// rttWindow is how many recent heartbeat round trips are kept for the histogram.
+const rttWindow = 128
+
+var rttBucketBounds = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Stats is a snapshot of the health of a Bot.
+type Stats struct {
+	State ConnectionState
+	// Latency is the round trip time of the last acknowledged heartbeat.
+	Latency time.Duration
+	// HeartbeatRTT summarizes the round trip times of the recent heartbeats.
+	HeartbeatRTT RTTHistogram
+	// HeartbeatRTTTotal summarizes the round trip times of all heartbeats so far. Its counts never
+	// decrease, unlike those of HeartbeatRTT, so it suits exporting as a Prometheus histogram.
+	HeartbeatRTTTotal RTTHistogram
+	// MissedAcks is the number of heartbeats that were not acknowledged before the next one was due.
+	MissedAcks uint64
+	// ReconnectAttempts is the number of times the Bot started waiting to connect again.
+	ReconnectAttempts uint64
+	// Reconnects is the number of times the connection came back.
+	Reconnects uint64
+	RateLimit  RateLimitStats
+}
+
+// RTTHistogram is a histogram of round trip times.
+type RTTHistogram struct {
+	// Buckets are cumulative: each one counts the samples at most its UpperBound.
+	Buckets []RTTBucket
+	Count   int
+	Sum     time.Duration
+	Max     time.Duration
+}
+
+type RTTBucket struct {
+	UpperBound time.Duration
+	Count      int
+}
+
+type gatewayStats struct {
+	mux               sync.Mutex
+	lastPing          time.Time
+	lastPong          time.Time
+	awaitingAck       bool
+	latency           time.Duration
+	rtts              []time.Duration
+	nextRTT           int
+	rttTotal          RTTHistogram
+	missedAcks        uint64
+	reconnectAttempts uint64
+	reconnects        uint64
+}
+
+// connected is called when heartbeats start on a new connection.
+func (stats *gatewayStats) connected(now time.Time) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	stats.lastPong = now
+	stats.awaitingAck = false
+}
+
+func (stats *gatewayStats) ping(now time.Time) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	if stats.awaitingAck {
+		stats.missedAcks++
+	}
+	stats.lastPing = now
+	stats.awaitingAck = true
+}
+
+func (stats *gatewayStats) ack(now time.Time) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	stats.lastPong = now
+	if !stats.awaitingAck {
+		return
+	}
+	stats.awaitingAck = false
+	stats.latency = now.Sub(stats.lastPing)
+	if len(stats.rtts) < rttWindow {
+		stats.rtts = append(stats.rtts, stats.latency)
+	} else {
+		stats.rtts[stats.nextRTT] = stats.latency
+		stats.nextRTT = (stats.nextRTT + 1) % rttWindow
+	}
+	if stats.rttTotal.Buckets == nil {
+		stats.rttTotal = newRTTHistogram()
+	}
+	stats.rttTotal.add(stats.latency)
+}
+
+func (stats *gatewayStats) sinceLastPong(now time.Time) time.Duration {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	return now.Sub(stats.lastPong)
+}
+
+func (stats *gatewayStats) reconnecting() {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	stats.reconnectAttempts++
+}
+
+func (stats *gatewayStats) reconnected() {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	stats.reconnects++
+}
+
+func (stats *gatewayStats) snapshot() Stats {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	r := Stats{
+		Latency:           stats.latency,
+		MissedAcks:        stats.missedAcks,
+		ReconnectAttempts: stats.reconnectAttempts,
+		Reconnects:        stats.reconnects,
+	}
+	r.HeartbeatRTT = newRTTHistogram()
+	for _, rtt := range stats.rtts {
+		r.HeartbeatRTT.add(rtt)
+	}
+	r.HeartbeatRTTTotal = newRTTHistogram()
+	r.HeartbeatRTTTotal.Count = stats.rttTotal.Count
+	r.HeartbeatRTTTotal.Sum = stats.rttTotal.Sum
+	r.HeartbeatRTTTotal.Max = stats.rttTotal.Max
+	if stats.rttTotal.Buckets != nil {
+		copy(r.HeartbeatRTTTotal.Buckets, stats.rttTotal.Buckets)
+	}
+	return r
+}
+
+func newRTTHistogram() RTTHistogram {
+	h := RTTHistogram{Buckets: make([]RTTBucket, len(rttBucketBounds))}
+	for i, bound := range rttBucketBounds {
+		h.Buckets[i].UpperBound = bound
+	}
+	return h
+}
+
+func (h *RTTHistogram) add(rtt time.Duration) {
+	h.Count++
+	h.Sum += rtt
+	if rtt > h.Max {
+		h.Max = rtt
+	}
+	for i := range h.Buckets {
+		if rtt <= h.Buckets[i].UpperBound {
+			h.Buckets[i].Count++
+		}
+	}
+}
+
+// Latency returns the round trip time of the last acknowledged heartbeat, or 0 if there is none yet.
+func (bot *Bot) Latency() time.Duration {
+	bot.stats.mux.Lock()
+	defer bot.stats.mux.Unlock()
+	return bot.stats.latency
+}
+
+// Stats returns a snapshot of the gateway health and REST rate limiting of bot.
+func (bot *Bot) Stats() Stats {
+	r := bot.stats.snapshot()
+	r.State = bot.State()
+	r.RateLimit = bot.limiter.stats()
+	return r
+}
@@ -0,0 +1,34 @@
+package tomon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatRTTTotalKeepsCountingPastTheWindow(t *testing.T) {
+	var stats gatewayStats
+	now := time.Now()
+	for i := 0; i < rttWindow+10; i++ {
+		rtt := 10 * time.Millisecond
+		if i >= rttWindow {
+			rtt = time.Second * 3
+		}
+		stats.ping(now)
+		now = now.Add(rtt)
+		stats.ack(now)
+	}
+	r := stats.snapshot()
+	if r.HeartbeatRTT.Count != rttWindow {
+		t.Errorf("window has %d samples, want %d", r.HeartbeatRTT.Count, rttWindow)
+	}
+	total := r.HeartbeatRTTTotal
+	if total.Count != rttWindow+10 {
+		t.Errorf("total has %d samples, want %d", total.Count, rttWindow+10)
+	}
+	if got := total.Buckets[0].Count; got != rttWindow {
+		t.Errorf("first bucket has %d samples, want %d", got, rttWindow)
+	}
+	if want := rttWindow*10*time.Millisecond + 10*3*time.Second; total.Sum != want {
+		t.Errorf("sum is %v, want %v", total.Sum, want)
+	}
+}
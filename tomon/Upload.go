@@ -0,0 +1,232 @@
+package tomon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+)
+
+// ErrUploadTooLarge is returned, possibly wrapped, when the files of a message exceed Options.MaxUploadSize.
+var ErrUploadTooLarge = errors.New("upload too large")
+
+// UploadProgress is called while an upload is sent with the bytes of the request body sent so far,
+// and the total size of the body, or -1 if it is unknown. sent starts over if the request is retried.
+type UploadProgress func(sent int64, total int64)
+
+// upload is a multipart request body streamed from its files through a pipe, so that
+// they are never held in memory as a whole.
+type upload struct {
+	boundary string
+	payload  []byte
+	files    []ReaderWithName
+	sizes    []int64
+	// starts are the initial offsets of the files, or nil if they cannot all be rewound.
+	starts []int64
+	// length is the size of the whole body, or -1 if a file size is unknown.
+	length   int64
+	maxSize  int64
+	progress UploadProgress
+	// pass is the latest pass over the upload.
+	pass *uploadReader
+}
+
+// uploadReader is one pass over an upload.
+type uploadReader struct {
+	*io.PipeReader
+	upload *upload
+	// done is closed once the goroutine writing the pass has stopped using the files.
+	done chan struct{}
+}
+
+func (bot *Bot) newUpload(payload []byte, files []ReaderWithName, progress UploadProgress) (*upload, error) {
+	u := &upload{
+		boundary: multipart.NewWriter(nil).Boundary(),
+		payload:  payload,
+		files:    files,
+		sizes:    make([]int64, len(files)),
+		starts:   make([]int64, len(files)),
+		maxSize:  bot.options.MaxUploadSize,
+		progress: progress,
+	}
+	var total int64
+	known := true
+	for i, file := range files {
+		u.sizes[i] = file.Size
+		if u.sizes[i] <= 0 {
+			u.sizes[i] = readerSize(file.Reader)
+		}
+		if u.sizes[i] < 0 {
+			known = false
+		} else {
+			total += u.sizes[i]
+		}
+		if u.starts != nil {
+			seeker, ok := file.Reader.(io.Seeker)
+			if !ok {
+				u.starts = nil
+				continue
+			}
+			start, err := seeker.Seek(0, io.SeekCurrent)
+			if err != nil {
+				u.starts = nil
+				continue
+			}
+			u.starts[i] = start
+		}
+	}
+	if u.maxSize > 0 && total > u.maxSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrUploadTooLarge, total, u.maxSize)
+	}
+	u.length = -1
+	if known {
+		overhead, err := u.overhead()
+		if err != nil {
+			return nil, err
+		}
+		u.length = overhead + total
+	}
+	return u, nil
+}
+
+// overhead returns the size of the body without the file contents.
+func (u *upload) overhead() (int64, error) {
+	var counter countWriter
+	err := u.writeTo(&counter, func(io.Writer, int) error { return nil })
+	return int64(counter), err
+}
+
+func (u *upload) contentType() string {
+	return "multipart/form-data; boundary=" + u.boundary
+}
+
+// open starts writing the body into a new pipe.
+func (u *upload) open() *uploadReader {
+	pr, pw := io.Pipe()
+	pass := &uploadReader{PipeReader: pr, upload: u, done: make(chan struct{})}
+	go func() {
+		defer close(pass.done)
+		var w io.Writer = pw
+		if u.progress != nil {
+			w = &progressWriter{w: w, total: u.length, fn: u.progress}
+		}
+		var sent int64
+		pw.CloseWithError(u.writeTo(w, func(fw io.Writer, i int) error {
+			file := u.files[i]
+			r := file.Reader
+			if u.maxSize > 0 {
+				r = io.LimitReader(r, u.maxSize-sent+1)
+			}
+			n, err := io.Copy(fw, r)
+			sent += n
+			if err != nil {
+				return err
+			}
+			if u.maxSize > 0 && sent > u.maxSize {
+				return fmt.Errorf("%w: more than %d bytes", ErrUploadTooLarge, u.maxSize)
+			}
+			if u.sizes[i] >= 0 && n != u.sizes[i] {
+				return fmt.Errorf("file %s has %d bytes, expected %d", file.Name, n, u.sizes[i])
+			}
+			return nil
+		}))
+	}()
+	u.pass = pass
+	return pass
+}
+
+func (u *upload) writeTo(w io.Writer, writeFile func(w io.Writer, i int) error) error {
+	writer := multipart.NewWriter(w)
+	err := writer.SetBoundary(u.boundary)
+	if err != nil {
+		return err
+	}
+	payloadWriter, err := writer.CreateFormField("payload_json")
+	if err != nil {
+		return err
+	}
+	_, err = payloadWriter.Write(u.payload)
+	if err != nil {
+		return err
+	}
+	for i, file := range u.files {
+		fileWriter, err := writer.CreateFormFile("files", file.Name)
+		if err != nil {
+			return err
+		}
+		err = writeFile(fileWriter, i)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// replay rewinds the files and returns a new pass over the upload, or nil if that is impossible.
+func (u *upload) replay() func() io.Reader {
+	if u.starts == nil {
+		return nil
+	}
+	return func() io.Reader {
+		// The server may have answered before reading the whole body, so the previous pass
+		// can still be copying from the files: stop it before rewinding them.
+		u.close()
+		for i, file := range u.files {
+			_, _ = file.Reader.(io.Seeker).Seek(u.starts[i], io.SeekStart)
+		}
+		return u.open()
+	}
+}
+
+// close stops the latest pass and waits until it no longer uses the files or reports progress.
+func (u *upload) close() {
+	if u.pass != nil {
+		u.pass.Close()
+		<-u.pass.done
+	}
+}
+
+func (r *uploadReader) contentLength() int64 {
+	return r.upload.length
+}
+
+// readerSize returns the number of bytes left in r, or -1 if it cannot be told without reading.
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - offset
+	}
+	return -1
+}
+
+type countWriter int64
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
+}
+
+type progressWriter struct {
+	w     io.Writer
+	sent  int64
+	total int64
+	fn    UploadProgress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.sent += int64(n)
+	w.fn(w.sent, w.total)
+	return n, err
+}
@@ -0,0 +1,195 @@
+package tomon_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+func testFile(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i%251)
+	}
+	return data
+}
+
+// TestUploadReplayAfterEarlyRateLimit sends large files through a proxy answering 429 before reading
+// the body, so that the first pass is still copying the files when the request is sent again.
+func TestUploadReplayAfterEarlyRateLimit(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	api, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: api.Scheme, Host: api.Host})
+	var limited int32
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/messages") && atomic.AddInt32(&limited, 1) == 1 {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+	options := testOptions(server)
+	options.BaseURL = front.URL + api.Path
+	options.HTTPClient = front.Client()
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	server.ResetRequests()
+
+	files := [][]byte{testFile(8<<20, 1), testFile(8<<20, 2)}
+	_, err = bot.SendMessage("20", tomon.MessageSend{Files: []tomon.ReaderWithName{
+		{Reader: bytes.NewReader(files[0]), Name: "a.bin"},
+		{Reader: bytes.NewReader(files[1]), Name: "b.bin"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&limited); n != 2 {
+		t.Fatalf("proxy got %d uploads, want 2", n)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("server got %d requests, want the retried upload only", len(requests))
+	}
+	_, params, err := mime.ParseMediaType(requests[0].Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := multipart.NewReader(bytes.NewReader(requests[0].Body), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatalf("failed to parse the retried upload: %v", err)
+	}
+	defer form.RemoveAll()
+	received := form.File["files"]
+	if len(received) != len(files) {
+		t.Fatalf("received %d files, want %d", len(received), len(files))
+	}
+	for i, header := range received {
+		f, err := header.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(data, files[i]) {
+			t.Errorf("file %d was corrupted by the retry", i)
+		}
+	}
+}
+
+func TestSendMessageUploadsFiles(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+	server.ResetRequests()
+
+	msg, err := bot.SendMessage("20", tomon.MessageSend{
+		Content: "files",
+		Files: []tomon.ReaderWithName{
+			{Reader: bytes.NewReader([]byte("first")), Name: "a.txt"},
+			{Reader: strings.NewReader("second file"), Name: "b.png", Size: 11},
+			// A reader of unknown size makes the body be sent without a Content-Length.
+			{Reader: onlyReader{strings.NewReader("third")}, Name: "c.bin"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content == nil || *msg.Content != "files" {
+		t.Errorf("content is %v, want files", msg.Content)
+	}
+	want := []struct {
+		name string
+		size int
+	}{{"a.txt", 5}, {"b.png", 11}, {"c.bin", 5}}
+	if len(msg.Attachments) != len(want) {
+		t.Fatalf("message has %d attachments, want %d", len(msg.Attachments), len(want))
+	}
+	for i, attachment := range msg.Attachments {
+		if attachment.Filename != want[i].name || attachment.Size != want[i].size {
+			t.Errorf("attachment %d is %s of %d bytes, want %s of %d bytes", i, attachment.Filename, attachment.Size, want[i].name, want[i].size)
+		}
+	}
+	requests := server.Requests()
+	if len(requests) != 1 || !strings.HasPrefix(requests[0].Header.Get("Content-Type"), "multipart/form-data") {
+		t.Fatalf("recorded %+v, want one multipart request", requests)
+	}
+}
+
+func TestMaxUploadSizeRefusesLargeFiles(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	options := testOptions(server)
+	options.MaxUploadSize = 8
+	bot := connectTestBot(t, server, options)
+	defer bot.Close()
+	server.ResetRequests()
+
+	_, err := bot.SendMessage("20", tomon.MessageSend{Files: []tomon.ReaderWithName{
+		{Reader: bytes.NewReader(make([]byte, 9)), Name: "big.bin"},
+	}})
+	if !errors.Is(err, tomon.ErrUploadTooLarge) {
+		t.Fatalf("got %v, want ErrUploadTooLarge", err)
+	}
+	if n := len(server.Requests()); n != 0 {
+		t.Errorf("%d requests were sent for a file known to be too large", n)
+	}
+
+	_, err = bot.SendMessage("20", tomon.MessageSend{Files: []tomon.ReaderWithName{
+		{Reader: onlyReader{bytes.NewReader(make([]byte, 9))}, Name: "big.bin"},
+	}})
+	if !errors.Is(err, tomon.ErrUploadTooLarge) {
+		t.Fatalf("got %v, want ErrUploadTooLarge for a file of unknown size", err)
+	}
+}
+
+// onlyReader hides every method of its reader but Read, so that its size is unknown.
+type onlyReader struct {
+	r interface{ Read([]byte) (int, error) }
+}
+
+func (r onlyReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func TestSendMessageReportsUploadProgress(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connectTestBot(t, server, testOptions(server))
+	defer bot.Close()
+
+	var calls int
+	var sent, total int64
+	_, err := bot.SendMessage("20", tomon.MessageSend{
+		Files: []tomon.ReaderWithName{{Reader: bytes.NewReader(make([]byte, 64<<10)), Name: "a.bin"}},
+		Progress: func(s int64, t int64) {
+			calls++
+			sent, total = s, t
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 || total < 64<<10 || sent != total {
+		t.Errorf("progress was called %d times, last with %d of %d bytes", calls, sent, total)
+	}
+}
@@ -0,0 +1,872 @@
+// Package tomontest provides an in-process fake Tomon server for testing bots offline.
+//
+// A Server serves both the REST API and the websocket gateway from a single httptest server.
+// Point a bot at it with tomon.NewWithOptions(login, server.Options()), then script gateway
+// dispatches with Dispatch and inspect the REST calls the bot made with Requests.
+package tomontest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentity       = 2
+	opHello          = 3
+	opHeartbeatAck   = 4
+	opResume         = 6
+	opInvalidSession = 9
+)
+
+// maxSessionHistory is how many dispatches are kept per session for replaying on resume.
+const maxSessionHistory = 1000
+
+const apiPrefix = "/api/v1"
+const gatewayPath = "/gateway"
+
+// Identity is the state sent to a bot in reply to its IDENTITY request.
+type Identity struct {
+	DMChannels []tomon.ChannelInfo `json:"dm_channels,omitempty"`
+	Guilds     []IdentityGuild     `json:"guilds"`
+}
+
+// IdentityGuild is a guild together with its channels and members, as found in an IDENTITY payload.
+type IdentityGuild struct {
+	tomon.GuildInfo
+	Channels []tomon.ChannelInfo `json:"channels"`
+	Members  []tomon.MemberInfo  `json:"members"`
+}
+
+// Request is a REST call recorded by the Server.
+type Request struct {
+	Method string
+	// Path is the endpoint relative to the API root, e.g. /channels/1/messages.
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+type gatewayConn struct {
+	conn    *websocket.Conn
+	mux     sync.Mutex
+	helloID string
+	session *session
+}
+
+type dispatchFrame struct {
+	Op int             `json:"op"`
+	E  string          `json:"e"`
+	D  json.RawMessage `json:"d"`
+	S  int64           `json:"s"`
+}
+
+// session outlives its connection so that a bot can resume it after reconnecting.
+type session struct {
+	id       string
+	sequence int64
+	history  []dispatchFrame
+	conn     *gatewayConn
+}
+
+func (c *gatewayConn) writeJSON(v interface{}) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.conn.WriteJSON(v)
+}
+
+type varsKey struct{}
+
+// Server is a fake Tomon REST API and gateway.
+//
+// Exported fields should be set before the bot logs in.
+type Server struct {
+	// Token is the bot token handed out by /auth/login and expected in IDENTITY.
+	Token string
+	// Self is the account returned by /auth/login.
+	Self tomon.SelfInfo
+	// Identity is sent to the bot once it has identified, with the last message ID of each
+	// channel brought up to date with the messages of the server.
+	Identity Identity
+	// HeartbeatInterval is announced in HELLO.
+	HeartbeatInterval time.Duration
+	// StampPacks are the stamp packs of the bot. Messages can only use stamps from them.
+	StampPacks []tomon.StampPackInfo
+
+	server    *httptest.Server
+	upgrader  websocket.Upgrader
+	mux       sync.Mutex
+	routes    []route
+	requests  []Request
+	conns     map[*gatewayConn]struct{}
+	sessions  map[string]*session
+	nextID    int64
+	sessionID int64
+	ready     chan struct{}
+	// messages are the messages of each channel, oldest first.
+	messages map[string][]tomon.MessageInfo
+}
+
+// NewServer starts a fake Tomon server with default handlers for login, channels, members and messages.
+func NewServer() *Server {
+	s := &Server{
+		Token: "tomontest-token",
+		Self: tomon.SelfInfo{
+			UserInfo: tomon.UserInfo{
+				ID:            "1",
+				Username:      "tomontest",
+				Discriminator: "0001",
+				Name:          "tomontest",
+				Type:          1,
+			},
+		},
+		HeartbeatInterval: 30 * time.Second,
+		conns:             make(map[*gatewayConn]struct{}),
+		sessions:          make(map[string]*session),
+		messages:          make(map[string][]tomon.MessageInfo),
+		nextID:            1000,
+		ready:             make(chan struct{}, 1),
+	}
+	s.HandleFunc("POST", "/auth/login", s.handleLogin)
+	s.HandleFunc("GET", "/channels/{channel}", s.handleGetChannel)
+	s.HandleFunc("GET", "/guilds/{guild}/channels", s.handleGetGuildChannels)
+	s.HandleFunc("GET", "/guilds/{guild}/members/{user}", s.handleGetMember)
+	s.HandleFunc("DELETE", "/guilds/{guild}/members/{user}", s.handleNoContent)
+	s.HandleFunc("POST", "/channels/{channel}/messages", s.handleCreateMessage)
+	s.HandleFunc("GET", "/channels/{channel}/messages", s.handleGetMessages)
+	s.HandleFunc("GET", "/users/@me/stamp-packs", s.handleGetStampPacks)
+	s.HandleFunc("POST", "/users/@me/channels", s.handleCreateDMChannel)
+	s.HandleFunc("PATCH", "/channels/{channel}/messages/{message}", s.handleEditMessage)
+	s.HandleFunc("DELETE", "/channels/{channel}/messages/{message}", s.handleNoContent)
+	s.HandleFunc("POST", "/channels/{channel}/messages/bulk-delete", s.handleNoContent)
+	s.HandleFunc("PUT", "/channels/{channel}/messages/{message}/reactions/{emoji}/@me", s.handleNoContent)
+	s.HandleFunc("DELETE", "/channels/{channel}/messages/{message}/reactions/{emoji}/{user}", s.handleNoContent)
+	s.HandleFunc("GET", "/channels/{channel}/messages/{message}/reactions/{emoji}", s.handleEmptyList)
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts down the server and drops every gateway connection.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.server.Close()
+}
+
+// URL returns the root of the fake REST API.
+func (s *Server) URL() string {
+	return s.server.URL + apiPrefix
+}
+
+// GatewayURL returns the websocket address of the fake gateway.
+func (s *Server) GatewayURL() string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http") + gatewayPath
+}
+
+// Options returns tomon.Options pointing at this server.
+func (s *Server) Options() tomon.Options {
+	return tomon.Options{
+		BaseURL:    s.URL(),
+		GatewayURL: s.GatewayURL(),
+		HTTPClient: s.server.Client(),
+	}
+}
+
+// NewID returns a fresh numeric ID, increasing on every call.
+func (s *Server) NewID() string {
+	return strconv.FormatInt(atomic.AddInt64(&s.nextID, 1), 10)
+}
+
+// HandleFunc registers a REST handler, replacing the default one for the same route.
+// Pattern segments written as {name} match any value and can be read back with Var.
+func (s *Server) HandleFunc(method string, pattern string, handler http.HandlerFunc) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r := route{method: method, segments: splitPath(pattern), handler: handler}
+	for i, existing := range s.routes {
+		if existing.method == r.method && equalSegments(existing.segments, r.segments) {
+			s.routes[i] = r
+			return
+		}
+	}
+	s.routes = append(s.routes, r)
+}
+
+// Var returns the value matched by the {name} segment of the route serving r.
+func Var(r *http.Request, name string) string {
+	vars, _ := r.Context().Value(varsKey{}).(map[string]string)
+	return vars[name]
+}
+
+// Requests returns every REST call received so far, in order.
+func (s *Server) Requests() []Request {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// ResetRequests forgets the recorded REST calls.
+func (s *Server) ResetRequests() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.requests = nil
+}
+
+// WaitReady blocks until a bot has identified on the gateway.
+func (s *Server) WaitReady(timeout time.Duration) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for a bot to identify")
+	}
+}
+
+// Dispatch sends a DISPATCH frame to every session. Sessions whose bot is disconnected
+// keep the frame and replay it if the bot resumes.
+func (s *Server) Dispatch(event string, data interface{}) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	if len(s.sessions) == 0 {
+		s.mux.Unlock()
+		return errors.New("no bot has identified on the gateway")
+	}
+	type delivery struct {
+		conn  *gatewayConn
+		frame dispatchFrame
+	}
+	var deliveries []delivery
+	for _, sess := range s.sessions {
+		sess.sequence++
+		frame := dispatchFrame{Op: opDispatch, E: event, D: d, S: sess.sequence}
+		sess.history = append(sess.history, frame)
+		if len(sess.history) > maxSessionHistory {
+			sess.history = sess.history[len(sess.history)-maxSessionHistory:]
+		}
+		if sess.conn != nil {
+			deliveries = append(deliveries, delivery{sess.conn, frame})
+		}
+	}
+	s.mux.Unlock()
+	for _, v := range deliveries {
+		// A failed write means the bot is gone; the frame stays in the history for resuming.
+		_ = v.conn.writeJSON(v.frame)
+	}
+	return nil
+}
+
+// DispatchGuildCreate sends a GUILD_CREATE dispatch.
+func (s *Server) DispatchGuildCreate(info tomon.GuildInfo) error {
+	return s.Dispatch("GUILD_CREATE", info)
+}
+
+// DispatchMessageCreate sends a MESSAGE_CREATE dispatch, filling in an ID if msg has none.
+func (s *Server) DispatchMessageCreate(msg tomon.MessageInfo) error {
+	if msg.ID == "" {
+		msg.ID = s.NewID()
+	}
+	s.AddMessages(msg)
+	return s.Dispatch("MESSAGE_CREATE", msg)
+}
+
+// AddMessages appends msgs to the history of their channels, served by GET /channels/{channel}/messages,
+// without dispatching them. Messages sent by the bot and by DispatchMessageCreate are added automatically.
+func (s *Server) AddMessages(msgs ...tomon.MessageInfo) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, msg := range msgs {
+		if msg.ChannelID == nil {
+			continue
+		}
+		s.messages[*msg.ChannelID] = append(s.messages[*msg.ChannelID], msg)
+	}
+}
+
+// InvalidateSessions forgets every session, so that reconnecting bots have to identify again.
+func (s *Server) InvalidateSessions() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sessions = make(map[string]*session)
+}
+
+// DropConnections closes every gateway connection abruptly, as a network failure would.
+// Sessions are kept and can be resumed.
+func (s *Server) DropConnections() {
+	s.mux.Lock()
+	conns := s.conns
+	s.conns = make(map[*gatewayConn]struct{})
+	for _, sess := range s.sessions {
+		sess.conn = nil
+	}
+	s.mux.Unlock()
+	for c := range conns {
+		_ = c.conn.Close()
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == gatewayPath {
+		s.serveGateway(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		writeError(w, http.StatusNotFound, "404: Not Found")
+		return
+	}
+	endpoint := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+
+	s.mux.Lock()
+	s.requests = append(s.requests, Request{
+		Method: r.Method,
+		Path:   endpoint,
+		Query:  r.URL.Query(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	var handler http.HandlerFunc
+	var vars map[string]string
+	segments := splitPath(endpoint)
+	for _, candidate := range s.routes {
+		if candidate.method != r.Method {
+			continue
+		}
+		if v, ok := matchSegments(candidate.segments, segments); ok {
+			handler, vars = candidate.handler, v
+			break
+		}
+	}
+	s.mux.Unlock()
+
+	if handler == nil {
+		writeError(w, http.StatusNotFound, "404: Not Found")
+		return
+	}
+	handler(w, r.WithContext(context.WithValue(r.Context(), varsKey{}, vars)))
+}
+
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &gatewayConn{
+		conn:    conn,
+		helloID: strconv.FormatInt(atomic.AddInt64(&s.sessionID, 1), 10),
+	}
+	s.mux.Lock()
+	s.conns[c] = struct{}{}
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		delete(s.conns, c)
+		if c.session != nil && c.session.conn == c {
+			c.session.conn = nil
+		}
+		s.mux.Unlock()
+		_ = conn.Close()
+	}()
+
+	err = c.writeJSON(map[string]interface{}{
+		"op": opHello,
+		"d": map[string]interface{}{
+			"heartbeat_interval": s.HeartbeatInterval.Milliseconds(),
+			"session_id":         c.helloID,
+		},
+	})
+	if err != nil {
+		return
+	}
+	for {
+		var frame struct {
+			Op int             `json:"op"`
+			D  json.RawMessage `json:"d,omitempty"`
+		}
+		if err := conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		switch frame.Op {
+		case opHeartbeat:
+			if err := c.writeJSON(map[string]interface{}{"op": opHeartbeatAck}); err != nil {
+				return
+			}
+		case opIdentity:
+			var request struct {
+				Token string `json:"token"`
+			}
+			_ = json.Unmarshal(frame.D, &request)
+			if request.Token != s.Token {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4004, "authentication failed"))
+				return
+			}
+			// Hold the lock until IDENTITY is written so that no dispatch can overtake it.
+			s.mux.Lock()
+			sess := &session{id: c.helloID, conn: c}
+			s.sessions[sess.id] = sess
+			c.session = sess
+			err := c.writeJSON(map[string]interface{}{"op": opIdentity, "d": s.identity()})
+			s.mux.Unlock()
+			if err != nil {
+				return
+			}
+			s.notifyReady()
+		case opResume:
+			var request struct {
+				Token     string `json:"token"`
+				SessionID string `json:"session_id"`
+				Sequence  int64  `json:"seq"`
+			}
+			_ = json.Unmarshal(frame.D, &request)
+			if request.Token != s.Token {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4004, "authentication failed"))
+				return
+			}
+			if err := s.resume(c, request.SessionID, request.Sequence); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// identity returns Identity with the last message ID of every channel filled in from its history.
+// The caller must hold s.mux.
+func (s *Server) identity() Identity {
+	r := Identity{DMChannels: s.withLastMessageIDs(s.Identity.DMChannels)}
+	for _, guild := range s.Identity.Guilds {
+		guild.Channels = s.withLastMessageIDs(guild.Channels)
+		r.Guilds = append(r.Guilds, guild)
+	}
+	return r
+}
+
+func (s *Server) withLastMessageIDs(channels []tomon.ChannelInfo) []tomon.ChannelInfo {
+	r := make([]tomon.ChannelInfo, len(channels))
+	for i, channel := range channels {
+		if msgs := s.messages[channel.ID]; len(msgs) != 0 && compareIDs(msgs[len(msgs)-1].ID, channel.LastMessageID) > 0 {
+			channel.LastMessageID = msgs[len(msgs)-1].ID
+		}
+		r[i] = channel
+	}
+	return r
+}
+
+func (s *Server) notifyReady() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// resume replays the dispatches after sequence and acknowledges the resumed session,
+// or answers INVALID_SESSION if the session is unknown or too much has been missed.
+func (s *Server) resume(c *gatewayConn, sessionID string, sequence int64) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if ok && len(sess.history) != 0 && sess.history[0].S > sequence+1 {
+		ok = false
+	}
+	if !ok {
+		return c.writeJSON(map[string]interface{}{"op": opInvalidSession})
+	}
+	sess.conn = c
+	c.session = sess
+	for _, frame := range sess.history {
+		if frame.S <= sequence {
+			continue
+		}
+		if err := c.writeJSON(frame); err != nil {
+			return err
+		}
+	}
+	err := c.writeJSON(map[string]interface{}{
+		"op": opResume,
+		"d":  map[string]interface{}{"session_id": sess.id},
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyReady()
+	return nil
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Token string `json:"token"`
+		tomon.SelfInfo
+	}{s.Token, s.Self})
+}
+
+func (s *Server) findChannel(channelID string) (tomon.ChannelInfo, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, channel := range s.Identity.DMChannels {
+		if channel.ID == channelID {
+			return channel, true
+		}
+	}
+	for _, guild := range s.Identity.Guilds {
+		for _, channel := range guild.Channels {
+			if channel.ID == channelID {
+				return channel, true
+			}
+		}
+	}
+	return tomon.ChannelInfo{}, false
+}
+
+// handleCreateDMChannel returns the DM channel with the recipient, adding it to Identity.DMChannels if it is new.
+func (s *Server) handleCreateDMChannel(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		RecipientID string `json:"recipient_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.RecipientID == "" {
+		writeError(w, http.StatusBadRequest, "Invalid Recipient")
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, channel := range s.Identity.DMChannels {
+		if channel.Type == tomon.ChannelTypeDM && len(channel.Recipients) == 1 && channel.Recipients[0].ID == payload.RecipientID {
+			writeJSON(w, http.StatusOK, channel)
+			return
+		}
+	}
+	recipient := tomon.UserInfo{ID: payload.RecipientID}
+	for _, guild := range s.Identity.Guilds {
+		for _, member := range guild.Members {
+			if member.User.ID == payload.RecipientID {
+				recipient = member.User
+			}
+		}
+	}
+	channel := tomon.ChannelInfo{
+		ID:         s.NewID(),
+		Type:       tomon.ChannelTypeDM,
+		Recipients: []tomon.UserInfo{recipient},
+	}
+	s.Identity.DMChannels = append(s.Identity.DMChannels, channel)
+	writeJSON(w, http.StatusOK, channel)
+}
+
+func (s *Server) handleGetChannel(w http.ResponseWriter, r *http.Request) {
+	channel, ok := s.findChannel(Var(r, "channel"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown Channel")
+		return
+	}
+	writeJSON(w, http.StatusOK, channel)
+}
+
+func (s *Server) handleGetGuildChannels(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, guild := range s.Identity.Guilds {
+		if guild.ID == Var(r, "guild") {
+			writeJSON(w, http.StatusOK, guild.Channels)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "Unknown Guild")
+}
+
+func (s *Server) handleGetMember(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, guild := range s.Identity.Guilds {
+		if guild.ID != Var(r, "guild") {
+			continue
+		}
+		for _, member := range guild.Members {
+			if member.User.ID == Var(r, "user") {
+				writeJSON(w, http.StatusOK, member)
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, "Unknown Member")
+}
+
+func (s *Server) handleNoContent(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) findMessage(channelID string, messageID string) (tomon.MessageInfo, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, msg := range s.messages[channelID] {
+		if msg.ID == messageID {
+			return msg, true
+		}
+	}
+	return tomon.MessageInfo{}, false
+}
+
+func (s *Server) findStamp(stampID string) (tomon.StampsInfo, bool) {
+	for _, pack := range s.StampPacks {
+		for _, stamp := range pack.Stamps {
+			if stamp.ID == stampID {
+				return stamp, true
+			}
+		}
+	}
+	return tomon.StampsInfo{}, false
+}
+
+func (s *Server) handleGetStampPacks(w http.ResponseWriter, r *http.Request) {
+	packs := s.StampPacks
+	if packs == nil {
+		packs = []tomon.StampPackInfo{}
+	}
+	writeJSON(w, http.StatusOK, packs)
+}
+
+func (s *Server) handleEmptyList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, []struct{}{})
+}
+
+func (s *Server) handleCreateMessage(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Content string   `json:"content"`
+		Nonce   string   `json:"nonce"`
+		Stamps  []string `json:"stamps"`
+		ReplyID string   `json:"reply_id"`
+	}
+	var attachments []tomon.AttachmentInfo
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			switch part.FormName() {
+			case "payload_json":
+				_ = json.Unmarshal(data, &payload)
+			default:
+				attachments = append(attachments, tomon.AttachmentInfo{
+					ID:       s.NewID(),
+					Filename: part.FileName(),
+					Type:     mime.TypeByExtension(fileExt(part.FileName())),
+					Size:     len(data),
+					URL:      fmt.Sprintf("%s/attachments/%s", s.server.URL, part.FileName()),
+				})
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var stamps []tomon.StampsInfo
+	for _, id := range payload.Stamps {
+		stamp, ok := s.findStamp(id)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Unknown Stamp")
+			return
+		}
+		stamps = append(stamps, stamp)
+	}
+	channelID := Var(r, "channel")
+	var reply *tomon.MessageInfo
+	if payload.ReplyID != "" {
+		replied, ok := s.findMessage(channelID, payload.ReplyID)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Unknown Message")
+			return
+		}
+		reply = &replied
+	}
+	self := s.Self.UserInfo
+	msg := tomon.MessageInfo{
+		Reply:       reply,
+		Stamps:      stamps,
+		ID:          s.NewID(),
+		ChannelID:   &channelID,
+		Author:      &self,
+		Content:     &payload.Content,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Nonce:       payload.Nonce,
+		Attachments: attachments,
+	}
+	s.AddMessages(msg)
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 50
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > tomon.MaxMessagesLimit {
+			writeError(w, http.StatusBadRequest, "Invalid Limit")
+			return
+		}
+		limit = n
+	}
+	s.mux.Lock()
+	all := s.messages[Var(r, "channel")]
+	s.mux.Unlock()
+	// all is oldest first, the response is newest first.
+	var page []tomon.MessageInfo
+	switch {
+	case query.Get("after") != "":
+		after := query.Get("after")
+		for _, msg := range all {
+			if len(page) < limit && compareIDs(msg.ID, after) > 0 {
+				page = append(page, msg)
+			}
+		}
+		reverse(page)
+	case query.Get("around") != "":
+		around := query.Get("around")
+		i := 0
+		for i < len(all) && compareIDs(all[i].ID, around) < 0 {
+			i++
+		}
+		start := i - limit/2
+		if start < 0 {
+			start = 0
+		}
+		end := start + limit
+		if end > len(all) {
+			end = len(all)
+		}
+		page = append(page, all[start:end]...)
+		reverse(page)
+	default:
+		before := query.Get("before")
+		for i := len(all) - 1; i >= 0 && len(page) < limit; i-- {
+			if before == "" || compareIDs(all[i].ID, before) < 0 {
+				page = append(page, all[i])
+			}
+		}
+	}
+	if page == nil {
+		page = []tomon.MessageInfo{}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func compareIDs(a string, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func reverse(msgs []tomon.MessageInfo) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
+
+func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	channelID := Var(r, "channel")
+	self := s.Self.UserInfo
+	edited := time.Now().UTC().Format(time.RFC3339Nano)
+	writeJSON(w, http.StatusOK, tomon.MessageInfo{
+		ID:              Var(r, "message"),
+		ChannelID:       &channelID,
+		Author:          &self,
+		Content:         &payload.Content,
+		EditedTimestamp: &edited,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"code":    0,
+		"message": message,
+	})
+}
+
+func fileExt(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[i:]
+	}
+	return ""
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func equalSegments(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func matchSegments(pattern []string, segments []string) (map[string]string, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	vars := make(map[string]string)
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			vars[p[1:len(p)-1]] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
@@ -0,0 +1,123 @@
+package tomontest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon"
+	"github.com/UBotPlatform/UBot.Account.Tomon/tomon/tomontest"
+)
+
+// connect logs a bot in to server and waits for it to identify.
+func connect(t *testing.T, server *tomontest.Server, options tomon.Options) *tomon.Bot {
+	t.Helper()
+	bot, err := tomon.NewWithOptions(&tomon.LoginByToken{Token: server.Token}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WaitReady(5 * time.Second); err != nil {
+		bot.Close()
+		t.Fatal(err)
+	}
+	return bot
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestDispatchReachesHandlers(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	server.Identity.Guilds = []tomontest.IdentityGuild{{
+		GuildInfo: tomon.GuildInfo{ID: "10", Name: "guild"},
+		Channels:  []tomon.ChannelInfo{{ID: "20", GuildID: "10", Name: "general"}},
+	}}
+	bot := connect(t, server, server.Options())
+	defer bot.Close()
+
+	if bot.Self().ID != server.Self.ID {
+		t.Errorf("logged in as %q, want %q", bot.Self().ID, server.Self.ID)
+	}
+	if _, ok := bot.Channels()["20"]; !ok {
+		t.Error("channel of the IDENTITY payload is not cached")
+	}
+	received := make(chan *tomon.MessageCreate, 1)
+	bot.AddHandler(func(e *tomon.MessageCreate) {
+		received <- e
+	})
+	err := server.DispatchMessageCreate(tomon.MessageInfo{
+		ChannelID: stringPtr("20"),
+		Author:    &tomon.UserInfo{ID: "30"},
+		Content:   stringPtr("hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-received:
+		if e.Content == nil || *e.Content != "hello" || e.Author.ID != "30" {
+			t.Errorf("received %+v", e.MessageInfo)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for MESSAGE_CREATE")
+	}
+}
+
+func TestRequestsRecordsRESTCalls(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connect(t, server, server.Options())
+	defer bot.Close()
+	server.ResetRequests()
+
+	msg, err := bot.CreateMessage("20", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content == nil || *msg.Content != "hi" || msg.Author.ID != server.Self.ID {
+		t.Errorf("created %+v", msg)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("recorded %d requests, want 1", len(requests))
+	}
+	r := requests[0]
+	if r.Method != "POST" || r.Path != "/channels/20/messages" {
+		t.Errorf("recorded %s %s", r.Method, r.Path)
+	}
+	if r.Header.Get("Authorization") != "Bearer "+server.Token {
+		t.Errorf("recorded Authorization %q", r.Header.Get("Authorization"))
+	}
+	var payload struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(r.Body, &payload); err != nil || payload.Content != "hi" {
+		t.Errorf("recorded body %s", r.Body)
+	}
+	server.ResetRequests()
+	if n := len(server.Requests()); n != 0 {
+		t.Errorf("%d requests left after ResetRequests", n)
+	}
+}
+
+func TestHandleFuncReplacesDefaultHandler(t *testing.T) {
+	server := tomontest.NewServer()
+	defer server.Close()
+	bot := connect(t, server, server.Options())
+	defer bot.Close()
+
+	server.HandleFunc("GET", "/channels/{channel}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tomon.ChannelInfo{ID: tomontest.Var(r, "channel"), Name: "replaced"})
+	})
+	channel, err := bot.Channel("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.ID != "42" || channel.Name != "replaced" {
+		t.Errorf("got %+v", channel)
+	}
+}